@@ -0,0 +1,148 @@
+package alertmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/notify"
+)
+
+// Alert is an alert as expected by the alertmanager v2 api.
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// Notifier posts an alert for every rule which is not OK to alertmanager.
+// Firing alerts are posted in every run and expire if veloci-meter stops sending them. When a rule returns to OK, or changes its
+// severity, the previous alert is posted once more as resolved.
+type Notifier struct {
+	c      *config.Alertmanager
+	ttl    time.Duration
+	client *http.Client
+
+	mu     sync.Mutex
+	firing map[string]*Alert
+}
+
+// New returns a notifier for the alertmanager defined in the config.
+// Firing alerts are valid for three check intervals.
+func New(c *config.Config) *Notifier {
+	return &Notifier{
+		c:      &c.Alertmanager,
+		ttl:    3 * time.Duration(c.CheckInterval) * time.Second,
+		client: &http.Client{Timeout: time.Duration(c.Alertmanager.Timeout) * time.Second},
+		firing: map[string]*Alert{},
+	}
+}
+
+// severity returns the value of the severity label for a state.
+func severity(s notify.State) string {
+	return strings.ToLower(s.String())
+}
+
+// alert returns a firing alert for the result.
+func (n *Notifier) alert(res *notify.Result, now time.Time) *Alert {
+	labels := map[string]string{}
+	for k, v := range n.c.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = "veloci-meter"
+	labels["rule"] = res.Name
+	labels["severity"] = severity(res.State)
+	labels["host"] = n.c.Hostname
+	return &Alert{
+		Labels: labels,
+		Annotations: map[string]string{
+			"summary": fmt.Sprintf("[%v] %v", res.State, res.Name),
+			"pattern": res.Pattern,
+			"count":   fmt.Sprint(res.Count),
+			"recent":  strings.Join(res.Recent, "\n"),
+		},
+		StartsAt: now,
+		EndsAt:   now.Add(n.ttl),
+	}
+}
+
+// Notify posts all firing and newly resolved alerts with a single request.
+func (n *Notifier) Notify(ctx context.Context, results []notify.Result) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	alerts := []*Alert{}
+	firing := map[string]*Alert{}
+	resolved := 0
+	for i := range results {
+		res := &results[i]
+		previous := n.firing[res.Name]
+		if res.State != notify.OK {
+			a := n.alert(res, now)
+			if previous != nil && previous.Labels["severity"] == a.Labels["severity"] {
+				a.StartsAt = previous.StartsAt
+				previous = nil
+			}
+			firing[res.Name] = a
+			alerts = append(alerts, a)
+		}
+		if previous != nil {
+			r := *previous
+			r.EndsAt = now
+			alerts = append(alerts, &r)
+			resolved++
+		}
+	}
+	if len(alerts) == 0 {
+		n.firing = firing
+		return nil
+	}
+
+	if err := n.post(ctx, alerts); err != nil {
+		// the alerts are resolved again in the next run
+		l.ErrorLog(err, "There was an error posting {{.count}} alerts to alertmanager.", map[string]interface{}{
+			"count": len(alerts),
+		})
+		return err
+	}
+	n.firing = firing
+	l.DebugLog("Posted {{.count}} alerts to alertmanager.", map[string]interface{}{
+		"count":    len(alerts),
+		"resolved": resolved,
+	})
+	return nil
+}
+
+func (n *Notifier) post(ctx context.Context, alerts []*Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(n.c.URL, "/") + "/api/v2/alerts"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alertmanager returned status %v: %s", resp.Status, b)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package alertmanager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestNotify(t *testing.T) {
+	var alerts []Alert
+	var path string
+	requests := 0
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		path = req.URL.Path
+		alerts = nil
+		json.NewDecoder(req.Body).Decode(&alerts)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Alertmanager.URL = server.URL + "/"
+	conf.Alertmanager.Labels = map[string]string{"team": "ops"}
+	n := New(conf)
+
+	// ok rules are not posted
+	results := []notify.Result{{Name: "first", State: notify.OK}, {Name: "second", State: notify.OK}}
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+	test.CheckResult(t, requests, 0)
+
+	results[0] = notify.Result{Name: "first", Pattern: "Backup", State: notify.WARNING, Count: 3, Recent: []string{"a", "b"}}
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+	test.CheckResult(t, path, "/api/v2/alerts")
+	test.CheckResult(t, len(alerts), 1)
+	test.CheckResult(t, alerts[0].Labels["rule"], "first")
+	test.CheckResult(t, alerts[0].Labels["severity"], "warning")
+	test.CheckResult(t, alerts[0].Labels["host"], "MAIL")
+	test.CheckResult(t, alerts[0].Labels["team"], "ops")
+	test.CheckResult(t, alerts[0].Annotations["pattern"], "Backup")
+	test.CheckResult(t, alerts[0].Annotations["count"], "3")
+	test.CheckResult(t, alerts[0].Annotations["recent"], "a\nb")
+	test.CheckResult(t, alerts[0].EndsAt.After(alerts[0].StartsAt), true)
+	startsAt := alerts[0].StartsAt
+
+	// a firing alert keeps its start
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(alerts), 1)
+	test.CheckResult(t, alerts[0].StartsAt.Equal(startsAt), true)
+
+	// a changed severity resolves the previous alert
+	results[0].State = notify.CRITICAL
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(alerts), 2)
+	test.CheckResult(t, alerts[0].Labels["severity"], "critical")
+	test.CheckResult(t, alerts[1].Labels["severity"], "warning")
+	test.CheckResult(t, alerts[1].EndsAt.After(alerts[1].StartsAt), true)
+
+	// resolved alerts are posted again if alertmanager is not reachable
+	results[0].State = notify.OK
+	status = http.StatusInternalServerError
+	test.CheckResult(t, n.Notify(context.Background(), results) != nil, true)
+	status = http.StatusOK
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(alerts), 1)
+	test.CheckResult(t, alerts[0].Labels["severity"], "critical")
+
+	// resolved alerts are only posted once
+	requests = 0
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+	test.CheckResult(t, requests, 0)
+}
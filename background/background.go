@@ -1,11 +1,14 @@
 package background
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	"niecke-it.de/veloci-meter/config"
-	"niecke-it.de/veloci-meter/icinga"
 	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/metrics"
+	"niecke-it.de/veloci-meter/notify"
 	"niecke-it.de/veloci-meter/rdb"
 	"niecke-it.de/veloci-meter/rules"
 )
@@ -15,122 +18,212 @@ import (
 // if not an alter level defined by the rule is set
 
 // CheckForAlerts is the main function which should run in an endless loop while the server is running an check mails stored in redis.
-// TODO add info in case the result from icinga is empty; this is beacause of missing check definitions
-func CheckForAlerts(config *config.Config, rules *rules.Rules) {
-	r := rdb.NewClient(&config.Redis)
+// The results of each run are passed to the notifier at once.
+// The notifier has to finish within the check interval, so a hanging backend does not block the next run.
+func CheckForAlerts(config *config.Config, rules *rules.Rules, r *rdb.Client, n notify.Notifier) {
 	for {
-		okFired, warningFired, criticalFired := iterateRules(config, rules, r)
+		results := Evaluate(config, rules, r)
 
-		iterateGlobals(config, rules, r)
+		// count the alerts in the statistics
+		for _, res := range results {
+			switch res.State {
+			case notify.CRITICAL:
+				r.IncreaseStatisticCountCritical(res.Name)
+			case notify.WARNING:
+				r.IncreaseStatisticCountWarning(res.Name)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.CheckInterval)*time.Second)
+		if err := n.Notify(ctx, results); err != nil {
+			l.ErrorLog(err, "Not all results could be send.", map[string]interface{}{
+				"count": len(results),
+			})
+		}
+		cancel()
 
+		fired := map[notify.State]int{}
+		for _, res := range results {
+			fired[res.State]++
+		}
 		l.InfoLog("Rule Status. Next run in {{.check_interval}}", map[string]interface{}{
-			"OK":             okFired,
-			"WARNING":        warningFired,
-			"CRITICAL":       criticalFired,
+			"OK":             fired[notify.OK],
+			"WARNING":        fired[notify.WARNING],
+			"CRITICAL":       fired[notify.CRITICAL],
+			"UNKNOWN":        fired[notify.UNKNOWN],
 			"check_interval": config.CheckInterval,
 		})
 		time.Sleep(time.Duration(config.CheckInterval) * time.Second)
 	}
 }
 
-func iterateRules(config *config.Config, rules *rules.Rules, r *rdb.Client) (int, int, int) {
-	criticalFired := 0
-	warningFired := 0
-	okFired := 0
-	// iterate over all rules
-	for _, rule := range rules.Rules {
-		actCount := r.CountMail(rule.Pattern)
-		if rule.Ok != 0 {
-			if actCount < rule.Ok {
-				if rule.Alert == "critical" {
-					icinga.SendResults(config, rule.Name, rule.Pattern, 2, actCount)
-					r.IncreaseStatisticCountCritical(rule.Name)
-					criticalFired++
-				} else {
-					icinga.SendResults(config, rule.Name, rule.Pattern, 1, actCount)
-					r.IncreaseStatisticCountWarning(rule.Name)
-					warningFired++
-				}
-			} else {
-				icinga.SendResults(config, rule.Name, rule.Pattern, 0, actCount)
-				okFired++
-			}
-		} else {
-			// remove all alerts if there are any
-			// the alert will be set again in each iteration
-			if actCount > rule.Critical {
-				icinga.SendResults(config, rule.Name, rule.Pattern, 2, actCount)
-				r.IncreaseStatisticCountCritical(rule.Name)
-				l.DebugLog("Rule {{.rule_name}} is {{.status}}", map[string]interface{}{
-					"rule_name": rule.Name,
-					"status":    "CRITICAL",
-				})
-				criticalFired++
-			} else if actCount > rule.Warning {
-				icinga.SendResults(config, rule.Name, rule.Pattern, 1, actCount)
-				r.IncreaseStatisticCountWarning(rule.Name)
-				l.DebugLog("Rule {{.rule_name}} is {{.status}}", map[string]interface{}{
-					"rule_name": rule.Name,
-					"status":    "WARNING",
-				})
-				warningFired++
-			} else {
-				icinga.SendResults(config, rule.Name, rule.Pattern, 0, actCount)
-				l.DebugLog("Rule {{.rule_name}} is {{.status}}", map[string]interface{}{
-					"rule_name": rule.Name,
-					"status":    "OK",
-				})
-				okFired++
-			}
+// Evaluate checks all rules and global windows against the counts stored in redis and returns their results.
+func Evaluate(config *config.Config, rules *rules.Rules, r *rdb.Client) []notify.Result {
+	results := iterateRules(config, rules, r)
+	return append(results, iterateGlobals(rules, r)...)
+}
+
+// Unknown returns an UNKNOWN result for all rules and global windows, e.g. if redis can not be reached.
+func Unknown(rules *rules.Rules) []notify.Result {
+	checks := rules.Checks()
+	results := make([]notify.Result, 0, len(checks))
+	for _, check := range checks {
+		results = append(results, notify.Result{Name: check.Name, Pattern: check.Pattern, State: notify.UNKNOWN})
+	}
+	return results
+}
+
+// ruleState returns the state of a rule for the number of mails currently stored for it.
+func ruleState(rule *rules.Rule, count int64) notify.State {
+	if rule.Ok != 0 {
+		if count >= rule.Ok {
+			return notify.OK
+		}
+		if rule.Alert == "critical" {
+			return notify.CRITICAL
 		}
+		return notify.WARNING
 	}
-	return okFired, warningFired, criticalFired
+	if count > rule.Critical {
+		return notify.CRITICAL
+	} else if count > rule.Warning {
+		return notify.WARNING
+	}
+	return notify.OK
 }
 
-func iterateGlobals(config *config.Config, rules *rules.Rules, r *rdb.Client) {
-	// check global counter 5 minutes
-	c5 := r.GetGlobalCounter(5)
-	// counter is above the defined limit => send icinga warning
-	if c5 > rules.Global.FiveMinutes {
-		icinga.SendResults(config, "Global 5m", "Global 5m", 1, int64(c5))
-		r.IncreaseStatisticCountWarning("Global 5m")
-		l.DebugLog("Global Rule for {{.timeframe}} is {{.status}}", map[string]interface{}{
-			"timeframe": "5m",
-			"status":    "WARNING",
-		})
-	} else {
-		icinga.SendResults(config, "Global 5m", "Global 5m", 0, int64(c5))
-		l.DebugLog("Global Rule for {{.timeframe}} is {{.status}}", map[string]interface{}{
-			"timeframe": "5m",
-			"status":    "OK",
+func iterateRules(config *config.Config, rules *rules.Rules, r *rdb.Client) []notify.Result {
+	results := make([]notify.Result, 0, len(rules.Rules))
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		start := time.Now()
+		actCount, err := r.CountMail(rule.ID())
+		end := time.Now()
+		// without a count from redis the state of the rule is unknown
+		state := notify.UNKNOWN
+		if err == nil {
+			state = ruleState(rule, actCount)
+		}
+		l.DebugLog("Rule {{.rule_name}} is {{.status}}", map[string]interface{}{
+			"rule_name": rule.Name,
+			"status":    state.String(),
+			"count":     actCount,
+			"error":     err,
 		})
+		res := notify.Result{
+			Name:     rule.Name,
+			Pattern:  rule.Pattern,
+			State:    state,
+			Count:    actCount,
+			Warning:  rule.Warning,
+			Critical: rule.Critical,
+			Ok:       rule.Ok,
+			Recent:   recentSubjects(config, r, rule),
+			Start:    start,
+			End:      end,
+		}
+		observeRule(&res)
+		results = append(results, res)
 	}
-	l.DebugLog("Global counter for {{.timeframe}} is at {{.count}}", map[string]interface{}{
-		"timeframe": "5m",
-		"count":     c5,
-		"limit":     rules.Global.FiveMinutes,
-	})
-
-	// check global counter 60 minutes
-	c60 := r.GetGlobalCounter(60)
-	// counter is above the defined limit => send icinga warning
-	if c60 > rules.Global.SixtyMinutes {
-		icinga.SendResults(config, "Global 60m", "Global 60m", 1, int64(c60))
-		r.IncreaseStatisticCountWarning("Global 60m")
-		l.DebugLog("Global Rule for {{.timeframe}} is {{.status}}", map[string]interface{}{
-			"timeframe": "60m",
-			"status":    "WARNING",
-		})
-	} else {
-		icinga.SendResults(config, "Global 60m", "Global 60m", 0, int64(c60))
+	return results
+}
+
+// recentSubjects returns the subjects of the latest mails matched by the rule which are still within the timeframe of the rule.
+// Since the subjects are only additional information errors are ignored. If Icinga.RecentSubjects is 0 or negative no subjects are returned.
+func recentSubjects(config *config.Config, r *rdb.Client, rule *rules.Rule) []string {
+	if *config.Icinga.RecentSubjects <= 0 {
+		return nil
+	}
+	matches, err := r.GetMatches(rule.ID(), *config.Icinga.RecentSubjects)
+	if err != nil {
+		return nil
+	}
+	timeframe := time.Duration(rule.Timeframe) * time.Second
+	subjects := make([]string, 0, len(matches))
+	for _, m := range matches {
+		// the mail has to be within the timeframe it was counted in, matches stored without a timestamp use the date
+		ts := m.Timestamp
+		if ts.IsZero() {
+			ts = m.Date
+		}
+		if !ts.IsZero() && time.Since(ts) >= timeframe {
+			continue
+		}
+		subjects = append(subjects, m.Subject)
+	}
+	return subjects
+}
+
+// globalWindows are the global rules checked in each run.
+var globalWindows = []struct {
+	name      string
+	timeframe int
+	limit     func(*rules.Global) int
+}{
+	{rules.GlobalNames["5m"], 5, func(g *rules.Global) int { return g.FiveMinutes }},
+	{rules.GlobalNames["60m"], 60, func(g *rules.Global) int { return g.SixtyMinutes }},
+}
+
+func iterateGlobals(rules *rules.Rules, r *rdb.Client) []notify.Result {
+	results := make([]notify.Result, 0, len(globalWindows))
+	for _, w := range globalWindows {
+		limit := w.limit(&rules.Global)
+		start := time.Now()
+		count, err := r.GetGlobalCounter(w.timeframe)
+		end := time.Now()
+		state := notify.OK
+		if err != nil {
+			// counter is unknown => send unknown
+			state = notify.UNKNOWN
+		} else if count > limit {
+			// counter is above the defined limit => send warning
+			state = notify.WARNING
+		}
 		l.DebugLog("Global Rule for {{.timeframe}} is {{.status}}", map[string]interface{}{
-			"timeframe": "60m",
-			"status":    "OK",
+			"timeframe": fmt.Sprintf("%dm", w.timeframe),
+			"status":    state.String(),
+			"count":     count,
+			"limit":     limit,
+			"error":     err,
 		})
+		res := notify.Result{
+			Name:    w.name,
+			Pattern: w.name,
+			State:   state,
+			Count:   int64(count),
+			Warning: int64(limit),
+			// global windows have no critical threshold
+			Critical: -1,
+			Start:    start,
+			End:      end,
+		}
+		observeGlobal(&res)
+		results = append(results, res)
+	}
+	return results
+}
+
+// observeRule updates the metrics of a rule with its latest result.
+func observeRule(res *notify.Result) {
+	metrics.RuleCount.WithLabelValues(res.Name).Set(float64(res.Count))
+	metrics.RuleState.WithLabelValues(res.Name).Set(float64(res.State))
+	// the same thresholds as in the performance data, a positive rule only has the ok threshold
+	thresholds := map[string]int64{"warning": res.Warning, "critical": res.Critical}
+	if res.Ok != 0 {
+		thresholds = map[string]int64{"ok": res.Ok}
 	}
-	l.DebugLog("Global counter for {{.timeframe}} is at {{.count}}", map[string]interface{}{
-		"timeframe": "60m",
-		"count":     c60,
-		"limit":     rules.Global.SixtyMinutes,
-	})
+	for _, threshold := range []string{"ok", "warning", "critical"} {
+		if value, ok := thresholds[threshold]; ok && value >= 0 {
+			metrics.RuleThreshold.WithLabelValues(res.Name, threshold).Set(float64(value))
+		} else {
+			metrics.RuleThreshold.DeleteLabelValues(res.Name, threshold)
+		}
+	}
+}
+
+// observeGlobal updates the metrics of a global window with its latest result.
+func observeGlobal(res *notify.Result) {
+	metrics.GlobalCount.WithLabelValues(res.Name).Set(float64(res.Count))
+	metrics.RuleState.WithLabelValues(res.Name).Set(float64(res.State))
+	metrics.RuleThreshold.WithLabelValues(res.Name, "warning").Set(float64(res.Warning))
 }
@@ -0,0 +1,131 @@
+package background
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/metrics"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/rdb"
+	"niecke-it.de/veloci-meter/rules"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestRuleState(t *testing.T) {
+	rule := rules.Rule{Name: "rule", Warning: 2, Critical: 5}
+	test.CheckResult(t, ruleState(&rule, 0), notify.OK)
+	test.CheckResult(t, ruleState(&rule, 2), notify.OK)
+	test.CheckResult(t, ruleState(&rule, 3), notify.WARNING)
+	test.CheckResult(t, ruleState(&rule, 6), notify.CRITICAL)
+
+	rule = rules.Rule{Name: "positive rule", Ok: 2}
+	test.CheckResult(t, ruleState(&rule, 2), notify.OK)
+	test.CheckResult(t, ruleState(&rule, 1), notify.WARNING)
+	rule.Alert = "critical"
+	test.CheckResult(t, ruleState(&rule, 1), notify.CRITICAL)
+}
+
+func TestEvaluate(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	r.Client().FlushDB()
+	rulesList := rules.LoadRules("../rules.example.json")
+
+	for i, subject := range []string{"Service-Mail 1", "Service-Mail 2", "Unknown"} {
+		msg := imap.Message{Envelope: &imap.Envelope{Subject: subject}, SeqNum: uint32(i)}
+		rule := rulesList.Match(subject)
+		b := r.NewBatch()
+		if rule != nil {
+			b.StoreMail(rule.ID(), &msg, rule.Timeframe, time.Now())
+		} else {
+			b.IncreaseGlobalCounter(5, time.Now())
+		}
+		test.CheckResult(t, b.Exec(), nil)
+	}
+
+	results := Evaluate(conf, rulesList, r)
+	test.CheckResult(t, len(results), len(rulesList.Rules)+2)
+	test.CheckResult(t, results[0].Name, "first rule")
+	test.CheckResult(t, results[0].Count, int64(2))
+	test.CheckResult(t, results[0].State, notify.WARNING)
+	test.CheckResult(t, results[0].Warning, int64(1))
+	test.CheckResult(t, results[2].Name, "positive rule")
+	test.CheckResult(t, results[2].State, notify.WARNING)
+	test.CheckResult(t, results[3].Name, "Global 5m")
+	test.CheckResult(t, results[3].Count, int64(1))
+	test.CheckResult(t, results[3].State, notify.OK)
+
+	// evaluating does not count alerts in the statistics
+	test.CheckResult(t, r.GetStatisticCount("first rule", int(time.Now().Unix())).Warning, int64(0))
+	r.Client().FlushDB()
+}
+
+func TestUnknown(t *testing.T) {
+	rulesList := rules.LoadRules("../rules.example.json")
+	results := Unknown(rulesList)
+	test.CheckResult(t, len(results), len(rulesList.Rules)+2)
+	for _, res := range results {
+		test.CheckResult(t, res.State, notify.UNKNOWN)
+	}
+	test.CheckResult(t, results[len(results)-1].Name, rules.GlobalNames["60m"])
+}
+
+func TestRecentSubjects(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	r.Client().FlushDB()
+	rule := rules.Rule{Name: "rule", Timeframe: 3600}
+
+	for _, m := range []rdb.Match{
+		{Subject: "old", Date: time.Now().Add(-2 * time.Hour)},
+		{Subject: "new", Date: time.Now()},
+		// the timestamp the mail was counted at is used instead of the date
+		{Subject: "counted late", Date: time.Now().Add(-2 * time.Hour), Timestamp: time.Now()},
+		{Subject: "counted early", Date: time.Now(), Timestamp: time.Now().Add(-2 * time.Hour)},
+	} {
+		test.CheckResult(t, r.StoreMatch(rule.ID(), m, rule.Timeframe), nil)
+	}
+	// mails older than the timeframe of the rule are not shown
+	subjects := recentSubjects(conf, r, &rule)
+	test.CheckResult(t, len(subjects), 2)
+	test.CheckResult(t, subjects[0], "counted late")
+	test.CheckResult(t, subjects[1], "new")
+
+	disabled := 0
+	conf.Icinga.RecentSubjects = &disabled
+	test.CheckResult(t, len(recentSubjects(conf, r, &rule)), 0)
+	r.Client().FlushDB()
+}
+
+func TestObserveRule(t *testing.T) {
+	res := notify.Result{Name: "rule", State: notify.WARNING, Count: 4, Warning: 3, Critical: 5}
+	observeRule(&res)
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleCount.WithLabelValues("rule")), float64(4))
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleState.WithLabelValues("rule")), float64(1))
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleThreshold.WithLabelValues("rule", "warning")), float64(3))
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleThreshold.WithLabelValues("rule", "critical")), float64(5))
+	test.CheckResult(t, metrics.RuleThreshold.DeleteLabelValues("rule", "ok"), false)
+
+	// a threshold of 0 is exported like in the performance data
+	res.Warning = 0
+	observeRule(&res)
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleThreshold.WithLabelValues("rule", "warning")), float64(0))
+
+	// a positive rule only exports the ok threshold
+	res.Ok = 2
+	observeRule(&res)
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleThreshold.WithLabelValues("rule", "ok")), float64(2))
+	test.CheckResult(t, metrics.RuleThreshold.DeleteLabelValues("rule", "warning"), false)
+	test.CheckResult(t, metrics.RuleThreshold.DeleteLabelValues("rule", "critical"), false)
+}
+
+func TestObserveGlobal(t *testing.T) {
+	res := notify.Result{Name: "Global 5m", State: notify.OK, Count: 7, Warning: 100}
+	observeGlobal(&res)
+	test.CheckResult(t, testutil.ToFloat64(metrics.GlobalCount.WithLabelValues("Global 5m")), float64(7))
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleState.WithLabelValues("Global 5m")), float64(0))
+	test.CheckResult(t, testutil.ToFloat64(metrics.RuleThreshold.WithLabelValues("Global 5m", "warning")), float64(100))
+}
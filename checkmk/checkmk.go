@@ -0,0 +1,91 @@
+package checkmk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"niecke-it.de/veloci-meter/config"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/notify"
+)
+
+// Notifier writes the results as local checks to the spool directory of the checkmk agent.
+type Notifier struct {
+	c *config.Checkmk
+}
+
+// New returns a notifier for the spool directory defined in the config.
+func New(c *config.Checkmk) *Notifier {
+	return &Notifier{c: c}
+}
+
+// SpoolFile returns the path of the spool file. The agent ignores the file if it is older than the max age in its name.
+func (n *Notifier) SpoolFile() string {
+	return filepath.Join(n.c.SpoolPath, fmt.Sprintf("%d_veloci-meter", n.c.MaxAge))
+}
+
+// Notify replaces the spool file with the results of the current run.
+// The file is written with a temporary name and renamed afterwards, so the agent never reads a partial file.
+func (n *Notifier) Notify(ctx context.Context, results []notify.Result) error {
+	path := n.SpoolFile()
+	if err := n.write(path, results); err != nil {
+		l.ErrorLog(err, "There was an error writing the spool file {{.path}}.", map[string]interface{}{
+			"path": path,
+		})
+		return err
+	}
+	l.DebugLog("Wrote {{.count}} local checks to {{.path}}.", map[string]interface{}{
+		"count": len(results),
+		"path":  path,
+	})
+	return nil
+}
+
+func (n *Notifier) write(path string, results []notify.Result) error {
+	// the temporary file starts with a dot so it is ignored by the agent
+	tmp, err := ioutil.TempFile(n.c.SpoolPath, ".veloci-meter")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// the agent adds the section header only for local checks it runs itself
+	if _, err := io.WriteString(tmp, "<<<local>>>\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := Write(tmp, results); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Write writes one local check per result without the section header, as expected from a local check run by the agent.
+func Write(w io.Writer, results []notify.Result) error {
+	for i := range results {
+		if _, err := io.WriteString(w, LocalCheck(&results[i])+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalCheck returns the local check line of a result with the count and the thresholds as performance data.
+// The long output is escaped, as a local check has to fit in a single line.
+func LocalCheck(res *notify.Result) string {
+	name := strings.Replace(res.Name, "\"", "'", -1)
+	output := strings.Replace(res.Output(), "\n", "\\n", -1)
+	return fmt.Sprintf("%d \"%s\" %s %s", int(res.State), name, res.PerfData(), output)
+}
@@ -0,0 +1,50 @@
+package checkmk
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestLocalCheck(t *testing.T) {
+	res := notify.Result{Name: "first rule", Pattern: "Backup", State: notify.WARNING, Count: 3, Warning: 2, Critical: 5, Recent: []string{"Backup failed"}}
+	test.CheckResult(t, LocalCheck(&res), "1 \"first rule\" count=3;2;5;0 [WARNING] Pattern: 'Backup'\\nRecent mails:\\nBackup failed")
+
+	res = notify.Result{Name: "say \"hi\"", Pattern: "hi", State: notify.OK, Count: 1, Ok: 1}
+	test.CheckResult(t, LocalCheck(&res), "0 \"say 'hi'\" count=1;;;0 [OK] Pattern: 'hi'")
+}
+
+func TestWrite(t *testing.T) {
+	var b bytes.Buffer
+	err := Write(&b, []notify.Result{{Name: "first", State: notify.OK}, {Name: "second", State: notify.CRITICAL}})
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, b.String(), "0 \"first\" count=0;0;0;0 [OK] Pattern: ''\n2 \"second\" count=0;0;0;0 [CRITICAL] Pattern: ''\n")
+}
+
+func TestNotify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	n := New(&config.Checkmk{SpoolPath: dir, MaxAge: 30})
+	test.CheckResult(t, n.SpoolFile(), filepath.Join(dir, "30_veloci-meter"))
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "first"}, {Name: "second"}}), nil)
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "first"}}), nil)
+
+	// the spool file is replaced and no temporary files are left
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	test.CheckResult(t, len(files), 1)
+	hidden, _ := filepath.Glob(filepath.Join(dir, ".*"))
+	test.CheckResult(t, len(hidden), 0)
+	b, _ := ioutil.ReadFile(n.SpoolFile())
+	test.CheckResult(t, string(b), "<<<local>>>\n0 \"first\" count=0;0;0;0 [OK] Pattern: ''\n")
+
+	n = New(&config.Checkmk{SpoolPath: filepath.Join(dir, "missing"), MaxAge: 30})
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "first"}}) != nil, true)
+}
@@ -11,31 +11,55 @@ import (
 	"niecke-it.de/veloci-meter/rules"
 )
 
-// CleanUp removes data for global rules which are older than one day.
-func CleanUp(conf *config.Config) {
+// CleanUp removes data for global rules which are older than one day and statistics which are older than the configured retention.
+// Only keys within the configured Redis.KeyPrefix are touched.
+func CleanUp(conf *config.Config, r *rdb.Client) {
 	l.DebugLog("Running clean up job.", nil)
 	timestamp := int(time.Now().Unix())
 	deletedKey := 0
-	l.DebugLog("Connecting to redis...", map[string]interface{}{"redis_uri": conf.Redis.URI})
-	r := rdb.NewClient(&conf.Redis)
 
 	for index, val := range rules.GlobalPatterns {
-		l.DebugLog("Checking {{.index}} keys...", map[string]interface{}{"index": index})
-		keys := r.GetKeys(val + "*")
-		for _, key := range keys {
-			ts, err := strconv.Atoi(strings.Replace(key, val, "", -1))
-			if err != nil {
-				l.ErrorLog(err, "There was an error converting {{.data}} to int.", map[string]interface{}{"data": key})
-			} else if timestamp-ts > 86400 {
-				// if the key is older than 24 hours -> delete it
-
-				redisReturn := r.DeleteKey(key)
-				l.InfoLog("Redis return for deleting {{.redis_key}} was {{.redis_result}}", map[string]interface{}{"redis_key": key, "redis_result": redisReturn})
-				deletedKey++
-			}
-		}
+		// if the key is older than 24 hours -> delete it
+		deletedKey += deleteKeys(r, index, val, timestamp-86400)
+	}
+
+	retention := map[string]int{
+		"daily":  conf.Stats.DailyRetention * 86400,
+		"hourly": conf.Stats.HourlyRetention * 3600,
+	}
+	for index, val := range rdb.StatsPatterns {
+		deletedKey += deleteKeys(r, index, val, timestamp-retention[index])
 	}
+
 	end := int(time.Now().Unix())
 	duration := end - timestamp
 	l.InfoLog("Cleanup job is done. Deleted {{.redis_key}} keys from redis in {{.duration}} seconds.", map[string]interface{}{"redis_key": deletedKey, "duration": duration})
 }
+
+// deleteKeys deletes all keys starting with prefix whose timestamp is older than before and returns the number of deleted keys.
+// The timestamp is expected to be the last part of the key.
+func deleteKeys(r *rdb.Client, index string, prefix string, before int) int {
+	deletedKey := 0
+	l.DebugLog("Checking {{.index}} keys...", map[string]interface{}{"index": index})
+	keys, err := r.GetKeys(prefix + "*")
+	if err != nil {
+		l.ErrorLog(err, "Skipping {{.index}} keys since they could not be read from redis.", map[string]interface{}{"index": index})
+		return 0
+	}
+	for _, key := range keys {
+		ts, err := keyTimestamp(key)
+		if err != nil {
+			l.ErrorLog(err, "There was an error converting {{.data}} to int.", map[string]interface{}{"data": key})
+		} else if ts < before {
+			redisReturn := r.DeleteKey(key)
+			l.InfoLog("Redis return for deleting {{.redis_key}} was {{.redis_result}}", map[string]interface{}{"redis_key": key, "redis_result": redisReturn})
+			deletedKey++
+		}
+	}
+	return deletedKey
+}
+
+// keyTimestamp returns the timestamp stored as last part of a redis key.
+func keyTimestamp(key string) (int, error) {
+	return strconv.Atoi(key[strings.LastIndex(key, ":")+1:])
+}
@@ -0,0 +1,47 @@
+package cleanup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/rdb"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestKeyTimestamp(t *testing.T) {
+	ts, err := keyTimestamp("stats:rule:with:colons:1606003200")
+	test.CheckResult(t, ts, 1606003200)
+	test.CheckResult(t, err, nil)
+
+	_, err = keyTimestamp("stats:rule")
+	test.CheckResult(t, err != nil, true)
+}
+
+func TestCleanUp(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	r.Client().FlushDB()
+
+	now := int(time.Now().Unix())
+	keys := map[string]bool{
+		"global:5:" + fmt.Sprint(now-2*86400):                                      false,
+		"global:5:" + fmt.Sprint(now):                                              true,
+		"stats:rule:" + fmt.Sprint(now-(conf.Stats.DailyRetention+1)*86400):        false,
+		"stats:rule:" + fmt.Sprint(now-86400):                                      true,
+		"stats-hourly:rule:" + fmt.Sprint(now-(conf.Stats.HourlyRetention+1)*3600): false,
+		"stats-hourly:rule:" + fmt.Sprint(now-3600):                                true,
+	}
+	for key := range keys {
+		r.Client().Set(key, 1, 0)
+	}
+
+	CleanUp(conf, r)
+
+	for key, kept := range keys {
+		test.CheckResult(t, r.Client().Exists(key).Val() == 1, kept)
+	}
+
+	r.Client().FlushDB()
+}
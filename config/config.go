@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -19,30 +20,123 @@ type Config struct {
 	CleanUpSchedule    string `json:"CleanUpSchedule,omitempty"`
 	StatsPath          string `json:"StatsPath,omitempty"`
 	InsecureSkipVerify *bool  `json:"InsecureSkipVerify,omitempty"`
+	Timezone           string `json:"Timezone,omitempty"`
 
-	Icinga Icinga `json:"Icinga"`
-	Redis  Redis  `json:"Redis,omitempty"`
-	Mail   Mail   `json:"Mail"`
+	// Notifiers are the backends the check results are send to.
+	Notifiers       []string `json:"Notifiers,omitempty"`
+	SendOnChange    *bool    `json:"SendOnChange,omitempty"`
+	RefreshInterval int      `json:"RefreshInterval,omitempty"`
+	Retry           Retry    `json:"Retry,omitempty"`
+
+	// Location is the parsed Timezone used for bucketing statistics and global windows.
+	Location *time.Location `json:"-"`
+
+	Icinga       Icinga       `json:"Icinga"`
+	Nagios       Nagios       `json:"Nagios,omitempty"`
+	Zabbix       Zabbix       `json:"Zabbix,omitempty"`
+	Checkmk      Checkmk      `json:"Checkmk,omitempty"`
+	Alertmanager Alertmanager `json:"Alertmanager,omitempty"`
+	Webhooks     []Webhook    `json:"Webhooks,omitempty"`
+
+	Redis   Redis   `json:"Redis,omitempty"`
+	Mail    Mail    `json:"Mail"`
+	Stats   Stats   `json:"Stats,omitempty"`
+	Metrics Metrics `json:"Metrics,omitempty"`
 }
 
 type Icinga struct {
-	Endpoint string `json:"Endpoint"`
-	User     string `json:"User"`
-	Password string `json:"Password"`
-	Hostname string `json:"Hostname,omitempty"`
+	Endpoint       string `json:"Endpoint"`
+	User           string `json:"User"`
+	Password       string `json:"Password"`
+	Hostname       string `json:"Hostname,omitempty"`
+	RecentSubjects *int   `json:"RecentSubjects,omitempty"`
+	Workers        int    `json:"Workers,omitempty"`
+	Timeout        int    `json:"Timeout,omitempty"`
+	SyncObjects    bool   `json:"SyncObjects,omitempty"`
+	RemoveObjects  bool   `json:"RemoveObjects,omitempty"`
+	CAFile         string `json:"CAFile,omitempty"`
+	CertFile       string `json:"CertFile,omitempty"`
+	KeyFile        string `json:"KeyFile,omitempty"`
+	ServerName     string `json:"ServerName,omitempty"`
+	TTL            int    `json:"TTL,omitempty"`
+	CheckSource    string `json:"CheckSource,omitempty"`
+}
+
+type Nagios struct {
+	CommandFile     string `json:"CommandFile,omitempty"`
+	CheckResultPath string `json:"CheckResultPath,omitempty"`
+	Hostname        string `json:"Hostname,omitempty"`
+}
+
+type Zabbix struct {
+	Server    string `json:"Server"`
+	Hostname  string `json:"Hostname,omitempty"`
+	KeyPrefix string `json:"KeyPrefix,omitempty"`
+	Timeout   int    `json:"Timeout,omitempty"`
+}
+
+type Checkmk struct {
+	SpoolPath string `json:"SpoolPath,omitempty"`
+	MaxAge    int    `json:"MaxAge,omitempty"`
+}
+
+type Alertmanager struct {
+	URL      string            `json:"URL"`
+	Hostname string            `json:"Hostname,omitempty"`
+	Labels   map[string]string `json:"Labels,omitempty"`
+	Timeout  int               `json:"Timeout,omitempty"`
+}
+
+type Webhook struct {
+	URL          string            `json:"URL"`
+	Method       string            `json:"Method,omitempty"`
+	Template     string            `json:"Template,omitempty"`
+	Headers      map[string]string `json:"Headers,omitempty"`
+	User         string            `json:"User,omitempty"`
+	Password     string            `json:"Password,omitempty"`
+	Token        string            `json:"Token,omitempty"`
+	Timeout      int               `json:"Timeout,omitempty"`
+	Retries      *int              `json:"Retries,omitempty"`
+	RetryBackoff int               `json:"RetryBackoff,omitempty"`
 }
 
 type Redis struct {
-	URI      string `json:"URI,omitempty"`
-	Password string `json:"Password,omitempty"`
-	Database int    `json:"Database,omitempty"`
+	URI            string `json:"URI,omitempty"`
+	Password       string `json:"Password,omitempty"`
+	Database       int    `json:"Database,omitempty"`
+	ConnectRetries int    `json:"ConnectRetries,omitempty"`
+	RetryBackoff   int    `json:"RetryBackoff,omitempty"`
+	MaxBackoff     int    `json:"MaxBackoff,omitempty"`
+	KeyPrefix      string `json:"KeyPrefix,omitempty"`
+	RecentMatches  int    `json:"RecentMatches,omitempty"`
+	DedupRetention int    `json:"DedupRetention,omitempty"`
+	Stream         string `json:"Stream,omitempty"`
+	StreamMaxLen   int64  `json:"StreamMaxLen,omitempty"`
 }
 
 type Mail struct {
-	URI       string `json:"URI,omitempty"`
-	User      string `json:"User,omitempty"`
-	Password  string `json:"Password,omitempty"`
-	BatchSize int    `json:"BatchSize"`
+	URI             string `json:"URI,omitempty"`
+	User            string `json:"User,omitempty"`
+	Password        string `json:"Password,omitempty"`
+	BatchSize       int    `json:"BatchSize"`
+	TimestampSource string `json:"TimestampSource,omitempty"`
+}
+
+type Stats struct {
+	DailyRetention  int `json:"DailyRetention,omitempty"`
+	HourlyRetention int `json:"HourlyRetention,omitempty"`
+}
+
+// Retry configures the queue of results which could not be sent.
+type Retry struct {
+	Enabled    *bool `json:"Enabled,omitempty"`
+	MaxSize    int   `json:"MaxSize,omitempty"`
+	Backoff    int   `json:"Backoff,omitempty"`
+	MaxBackoff int   `json:"MaxBackoff,omitempty"`
+}
+
+type Metrics struct {
+	Listen string `json:"Listen,omitempty"`
 }
 
 var LogLevels = map[string]bool{
@@ -58,6 +152,22 @@ var LogFormats = map[string]bool{
 	"JSON":  true,
 }
 
+// Notifiers contains all supported backends for check results.
+var Notifiers = map[string]bool{
+	"icinga":       true,
+	"alertmanager": true,
+	"checkmk":      true,
+	"nagios":       true,
+	"webhook":      true,
+	"zabbix":       true,
+}
+
+var TimestampSources = map[string]bool{
+	"DATE":         true,
+	"INTERNALDATE": true,
+	"NOW":          true,
+}
+
 func LoadConfig(path string) (c *Config) {
 	//##### CONFIG #####
 	var config Config
@@ -75,6 +185,16 @@ func LoadConfig(path string) (c *Config) {
 		l.FatalLog(err, "Can't parse config file '{{.path}}'", map[string]interface{}{"path": path})
 	}
 
+	if len(config.Notifiers) == 0 {
+		l.DebugLog("Notifiers not set. Using default: [icinga].", map[string]interface{}{})
+		config.Notifiers = []string{"icinga"}
+	}
+	for _, n := range config.Notifiers {
+		if !Notifiers[n] {
+			l.FatalLog(nil, "Notifier '{{.notifier}}' not supported.", map[string]interface{}{"notifier": n})
+		}
+	}
+
 	CheckRequiredFields(&config)
 
 	// check for none required configs
@@ -85,11 +205,33 @@ func LoadConfig(path string) (c *Config) {
 		config.InsecureSkipVerify = f
 	}
 
+	if config.SendOnChange == nil {
+		t := new(bool)
+		*t = true
+		l.DebugLog("SendOnChange not set. Using default: true.", map[string]interface{}{})
+		config.SendOnChange = t
+	}
+
+	if config.RefreshInterval == 0 {
+		l.DebugLog("RefreshInterval not set. Using default: 300.", map[string]interface{}{})
+		config.RefreshInterval = 300
+	}
+
 	if config.StatsPath == "" {
 		l.WarnLog("StatsPath not set. Using default: /var/log/veloci-meter/stats.", map[string]interface{}{})
 		config.StatsPath = "/var/log/veloci-meter/stats"
 	}
 
+	if config.Stats.DailyRetention == 0 {
+		l.DebugLog("Stats.DailyRetention not set. Using default: 90.", map[string]interface{}{})
+		config.Stats.DailyRetention = 90
+	}
+
+	if config.Stats.HourlyRetention == 0 {
+		l.DebugLog("Stats.HourlyRetention not set. Using default: 48.", map[string]interface{}{})
+		config.Stats.HourlyRetention = 48
+	}
+
 	l.DebugLog("Testing stats file...", map[string]interface{}{"path": path})
 	_, err = os.Stat(config.StatsPath)
 	if os.IsNotExist(err) {
@@ -127,11 +269,30 @@ func LoadConfig(path string) (c *Config) {
 		config.LogFormat = "PLAIN"
 	}
 
+	if config.Timezone == "" {
+		l.DebugLog("Timezone not set. Using default: UTC.", map[string]interface{}{})
+		config.Timezone = "UTC"
+	}
+	config.Location, err = time.LoadLocation(config.Timezone)
+	if err != nil {
+		l.WarnLog("Timezone '{{.timezone}}' not supported. Falling back to UTC.", map[string]interface{}{"error": err, "timezone": config.Timezone})
+		config.Timezone = "UTC"
+		config.Location = time.UTC
+	}
+
 	if config.Mail.BatchSize == 0 {
 		l.DebugLog("Mail.BatchSize not set. Using default: 5.", map[string]interface{}{})
 		config.Mail.BatchSize = 5
 	}
 
+	if config.Mail.TimestampSource == "" {
+		l.DebugLog("Mail.TimestampSource not set. Using default: DATE.", map[string]interface{}{})
+		config.Mail.TimestampSource = "DATE"
+	} else if !TimestampSources[config.Mail.TimestampSource] {
+		l.WarnLog("Mail.TimestampSource '{{.timestamp_source}}' not supported. Falling back to DATE.", map[string]interface{}{"timestamp_source": config.Mail.TimestampSource})
+		config.Mail.TimestampSource = "DATE"
+	}
+
 	if config.FetchInterval == 0 {
 		l.DebugLog("FetchInterval not set. Using default: 10.", map[string]interface{}{})
 		config.FetchInterval = 10
@@ -147,11 +308,165 @@ func LoadConfig(path string) (c *Config) {
 		config.Icinga.Hostname = "MAIL"
 	}
 
+	if config.Icinga.Workers < 1 {
+		l.DebugLog("Icinga.Workers not set. Using default: 4.", map[string]interface{}{})
+		config.Icinga.Workers = 4
+	}
+
+	if config.Icinga.Timeout == 0 {
+		l.DebugLog("Icinga.Timeout not set. Using default: 10.", map[string]interface{}{})
+		config.Icinga.Timeout = 10
+	}
+
+	if config.Icinga.TTL == 0 {
+		// with SendOnChange unchanged results are only send every RefreshInterval
+		ttl := 3 * config.CheckInterval
+		if *config.SendOnChange {
+			ttl += config.RefreshInterval
+		}
+		l.DebugLog("Icinga.TTL not set. Using default: {{.ttl}}.", map[string]interface{}{"ttl": ttl})
+		config.Icinga.TTL = ttl
+	}
+
+	if config.Icinga.CheckSource == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "veloci-meter"
+		}
+		l.DebugLog("Icinga.CheckSource not set. Using default: {{.check_source}}.", map[string]interface{}{"check_source": hostname})
+		config.Icinga.CheckSource = hostname
+	}
+
+	if config.Nagios.Hostname == "" {
+		l.DebugLog("Nagios.Hostname not set. Using default: MAIL.", map[string]interface{}{})
+		config.Nagios.Hostname = "MAIL"
+	}
+
+	if config.Checkmk.SpoolPath == "" {
+		l.DebugLog("Checkmk.SpoolPath not set. Using default: /var/lib/check_mk_agent/spool.", map[string]interface{}{})
+		config.Checkmk.SpoolPath = "/var/lib/check_mk_agent/spool"
+	}
+
+	if config.Retry.Enabled == nil {
+		t := new(bool)
+		*t = true
+		l.DebugLog("Retry.Enabled not set. Using default: true.", map[string]interface{}{})
+		config.Retry.Enabled = t
+	}
+
+	if config.Retry.MaxSize == 0 {
+		l.DebugLog("Retry.MaxSize not set. Using default: 1000.", map[string]interface{}{})
+		config.Retry.MaxSize = 1000
+	}
+
+	if config.Retry.Backoff == 0 {
+		l.DebugLog("Retry.Backoff not set. Using default: {{.backoff}}.", map[string]interface{}{"backoff": config.CheckInterval})
+		config.Retry.Backoff = config.CheckInterval
+	}
+
+	if config.Retry.MaxBackoff == 0 {
+		l.DebugLog("Retry.MaxBackoff not set. Using default: 600.", map[string]interface{}{})
+		config.Retry.MaxBackoff = 600
+	}
+
+	if config.Checkmk.MaxAge == 0 {
+		l.DebugLog("Checkmk.MaxAge not set. Using default: {{.max_age}}.", map[string]interface{}{"max_age": 3 * config.CheckInterval})
+		config.Checkmk.MaxAge = 3 * config.CheckInterval
+	}
+
+	if config.Zabbix.Hostname == "" {
+		l.DebugLog("Zabbix.Hostname not set. Using default: MAIL.", map[string]interface{}{})
+		config.Zabbix.Hostname = "MAIL"
+	}
+
+	if config.Zabbix.KeyPrefix == "" {
+		l.DebugLog("Zabbix.KeyPrefix not set. Using default: veloci-meter.", map[string]interface{}{})
+		config.Zabbix.KeyPrefix = "veloci-meter"
+	}
+
+	if config.Zabbix.Timeout == 0 {
+		l.DebugLog("Zabbix.Timeout not set. Using default: 10.", map[string]interface{}{})
+		config.Zabbix.Timeout = 10
+	}
+
+	if config.Alertmanager.Hostname == "" {
+		l.DebugLog("Alertmanager.Hostname not set. Using default: MAIL.", map[string]interface{}{})
+		config.Alertmanager.Hostname = "MAIL"
+	}
+
+	if config.Alertmanager.Timeout == 0 {
+		l.DebugLog("Alertmanager.Timeout not set. Using default: 10.", map[string]interface{}{})
+		config.Alertmanager.Timeout = 10
+	}
+
+	for i := range config.Webhooks {
+		w := &config.Webhooks[i]
+		if w.Method == "" {
+			w.Method = "POST"
+		}
+		if w.Timeout == 0 {
+			w.Timeout = 10
+		}
+		if w.Retries == nil {
+			// failed results are already sent again by the retry queue
+			retries := 3
+			if *config.Retry.Enabled {
+				retries = 0
+			}
+			w.Retries = &retries
+		}
+		if w.RetryBackoff == 0 {
+			w.RetryBackoff = 1
+		}
+	}
+
+	if config.Icinga.RecentSubjects == nil {
+		n := 3
+		l.DebugLog("Icinga.RecentSubjects not set. Using default: 3.", map[string]interface{}{})
+		config.Icinga.RecentSubjects = &n
+	}
+
 	if config.Redis.URI == "" {
 		l.DebugLog("Redis.URI not set. Using default: localhost:6379.", map[string]interface{}{})
 		config.Redis.URI = "localhost:6379"
 	}
 
+	if config.Redis.ConnectRetries == 0 {
+		l.DebugLog("Redis.ConnectRetries not set. Using default: 10.", map[string]interface{}{})
+		config.Redis.ConnectRetries = 10
+	}
+
+	if config.Redis.RetryBackoff == 0 {
+		l.DebugLog("Redis.RetryBackoff not set. Using default: 1.", map[string]interface{}{})
+		config.Redis.RetryBackoff = 1
+	}
+
+	if config.Redis.MaxBackoff == 0 {
+		l.DebugLog("Redis.MaxBackoff not set. Using default: 60.", map[string]interface{}{})
+		config.Redis.MaxBackoff = 60
+	}
+
+	if config.Redis.RecentMatches == 0 {
+		l.DebugLog("Redis.RecentMatches not set. Using default: 10.", map[string]interface{}{})
+		config.Redis.RecentMatches = 10
+	}
+
+	if config.Redis.DedupRetention == 0 {
+		l.DebugLog("Redis.DedupRetention not set. Using default: 86400.", map[string]interface{}{})
+		config.Redis.DedupRetention = 86400
+	}
+
+	if config.Redis.StreamMaxLen == 0 {
+		l.DebugLog("Redis.StreamMaxLen not set. Using default: 10000.", map[string]interface{}{})
+		config.Redis.StreamMaxLen = 10000
+	}
+
+	if strings.ContainsAny(config.Redis.KeyPrefix, "*?[]\\ ") {
+		l.FatalLog(nil, "Redis.KeyPrefix '{{.key_prefix}}' must not contain spaces or any of the characters *?[]\\", map[string]interface{}{"key_prefix": config.Redis.KeyPrefix})
+	} else if config.Redis.KeyPrefix != "" && !strings.HasSuffix(config.Redis.KeyPrefix, ":") {
+		config.Redis.KeyPrefix += ":"
+	}
+
 	p := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
 	_, err = p.Parse(config.CleanUpSchedule)
 
@@ -168,9 +483,43 @@ func CheckRequiredFields(c *Config) {
 	CheckRequiredField(c.Mail.URI, "Mail.URI")
 	CheckRequiredField(c.Mail.User, "Mail.User")
 	CheckRequiredField(c.Mail.Password, "Mail.Password")
-	CheckRequiredField(c.Icinga.Endpoint, "Icinga.Endpoint")
-	CheckRequiredField(c.Icinga.User, "Icinga.User")
-	CheckRequiredField(c.Icinga.Password, "Icinga.Password")
+	if c.HasNotifier("icinga") {
+		CheckRequiredField(c.Icinga.Endpoint, "Icinga.Endpoint")
+		// api users can be authenticated by a client certificate instead of a password
+		if c.Icinga.CertFile == "" {
+			CheckRequiredField(c.Icinga.User, "Icinga.User")
+			CheckRequiredField(c.Icinga.Password, "Icinga.Password")
+		} else {
+			CheckRequiredField(c.Icinga.KeyFile, "Icinga.KeyFile")
+		}
+	}
+	if c.HasNotifier("zabbix") {
+		CheckRequiredField(c.Zabbix.Server, "Zabbix.Server")
+	}
+	if c.HasNotifier("alertmanager") {
+		CheckRequiredField(c.Alertmanager.URL, "Alertmanager.URL")
+	}
+	if c.HasNotifier("webhook") {
+		if len(c.Webhooks) == 0 {
+			l.FatalLog(nil, "ConfigError: Webhooks has to contain at least one webhook for the webhook notifier.", nil)
+		}
+		for _, w := range c.Webhooks {
+			CheckRequiredField(w.URL, "Webhooks.URL")
+		}
+	}
+	if c.HasNotifier("nagios") && c.Nagios.CommandFile == "" && c.Nagios.CheckResultPath == "" {
+		l.FatalLog(nil, "ConfigError: Nagios.CommandFile or Nagios.CheckResultPath has to be set for the nagios notifier.", nil)
+	}
+}
+
+// HasNotifier returns true if the notifier with the given name is enabled.
+func (c *Config) HasNotifier(name string) bool {
+	for _, n := range c.Notifiers {
+		if n == name {
+			return true
+		}
+	}
+	return false
 }
 
 func CheckRequiredField(key interface{}, keyName string) {
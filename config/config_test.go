@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	l "github.com/sirupsen/logrus"
 	"niecke-it.de/veloci-meter/test"
@@ -15,6 +16,7 @@ func TestLoadConfigExample(t *testing.T) {
 	test.CheckResult(t, conf.Mail.User, "test@local")
 	test.CheckResult(t, conf.Mail.Password, "xxxxxx")
 	test.CheckResult(t, conf.Mail.BatchSize, 5)
+	test.CheckResult(t, conf.Mail.TimestampSource, "DATE")
 	test.CheckResult(t, conf.FetchInterval, 10)
 	test.CheckResult(t, conf.CheckInterval, 10)
 	test.CheckResult(t, conf.LogLevel, "INFO")
@@ -27,6 +29,40 @@ func TestLoadConfigExample(t *testing.T) {
 	test.CheckResult(t, conf.Redis.URI, "localhost:6379")
 	test.CheckResult(t, conf.Redis.Password, "")
 	test.CheckResult(t, conf.Redis.Database, 0)
+	test.CheckResult(t, conf.Redis.ConnectRetries, 10)
+	test.CheckResult(t, conf.Redis.RetryBackoff, 1)
+	test.CheckResult(t, conf.Redis.MaxBackoff, 60)
+	test.CheckResult(t, conf.Redis.RecentMatches, 10)
+	test.CheckResult(t, conf.Redis.DedupRetention, 86400)
+	test.CheckResult(t, conf.Redis.Stream, "")
+	test.CheckResult(t, conf.Redis.StreamMaxLen, int64(10000))
+	test.CheckResult(t, conf.Stats.DailyRetention, 90)
+	test.CheckResult(t, conf.Stats.HourlyRetention, 48)
+	test.CheckResult(t, conf.Timezone, "UTC")
+	test.CheckResult(t, conf.Location, time.UTC)
+	test.CheckResult(t, *conf.Icinga.RecentSubjects, 3)
+	test.CheckResult(t, len(conf.Notifiers), 1)
+	test.CheckResult(t, conf.HasNotifier("icinga"), true)
+	test.CheckResult(t, conf.Metrics.Listen, "")
+	test.CheckResult(t, conf.Nagios.Hostname, "MAIL")
+	test.CheckResult(t, conf.Alertmanager.Hostname, "MAIL")
+	test.CheckResult(t, conf.Alertmanager.Timeout, 10)
+	test.CheckResult(t, conf.Zabbix.Hostname, "MAIL")
+	test.CheckResult(t, conf.Zabbix.KeyPrefix, "veloci-meter")
+	test.CheckResult(t, conf.Zabbix.Timeout, 10)
+	test.CheckResult(t, conf.Checkmk.SpoolPath, "/var/lib/check_mk_agent/spool")
+	test.CheckResult(t, conf.Checkmk.MaxAge, 30)
+	test.CheckResult(t, *conf.SendOnChange, true)
+	test.CheckResult(t, conf.RefreshInterval, 300)
+	test.CheckResult(t, *conf.Retry.Enabled, true)
+	test.CheckResult(t, conf.Retry.MaxSize, 1000)
+	test.CheckResult(t, conf.Retry.Backoff, 10)
+	test.CheckResult(t, conf.Retry.MaxBackoff, 600)
+	test.CheckResult(t, conf.Icinga.Workers, 4)
+	test.CheckResult(t, conf.Icinga.Timeout, 10)
+	test.CheckResult(t, conf.Icinga.SyncObjects, false)
+	test.CheckResult(t, conf.Icinga.CAFile, "")
+	test.CheckResult(t, conf.Icinga.TTL, 330)
 }
 
 func TestLoadConfigMinimum(t *testing.T) {
@@ -37,6 +73,7 @@ func TestLoadConfigMinimum(t *testing.T) {
 	test.CheckResult(t, conf.Mail.User, "test@local")
 	test.CheckResult(t, conf.Mail.Password, "xxxxxxx")
 	test.CheckResult(t, conf.Mail.BatchSize, 5)
+	test.CheckResult(t, conf.Mail.TimestampSource, "DATE")
 	test.CheckResult(t, conf.FetchInterval, 10)
 	test.CheckResult(t, conf.CheckInterval, 10)
 	test.CheckResult(t, conf.LogLevel, "INFO")
@@ -49,6 +86,40 @@ func TestLoadConfigMinimum(t *testing.T) {
 	test.CheckResult(t, conf.Redis.URI, "localhost:6379")
 	test.CheckResult(t, conf.Redis.Password, "")
 	test.CheckResult(t, conf.Redis.Database, 0)
+	test.CheckResult(t, conf.Redis.ConnectRetries, 10)
+	test.CheckResult(t, conf.Redis.RetryBackoff, 1)
+	test.CheckResult(t, conf.Redis.MaxBackoff, 60)
+	test.CheckResult(t, conf.Redis.RecentMatches, 10)
+	test.CheckResult(t, conf.Redis.DedupRetention, 86400)
+	test.CheckResult(t, conf.Redis.Stream, "")
+	test.CheckResult(t, conf.Redis.StreamMaxLen, int64(10000))
+	test.CheckResult(t, conf.Stats.DailyRetention, 90)
+	test.CheckResult(t, conf.Stats.HourlyRetention, 48)
+	test.CheckResult(t, conf.Timezone, "UTC")
+	test.CheckResult(t, conf.Location, time.UTC)
+	test.CheckResult(t, *conf.Icinga.RecentSubjects, 3)
+	test.CheckResult(t, len(conf.Notifiers), 1)
+	test.CheckResult(t, conf.HasNotifier("icinga"), true)
+	test.CheckResult(t, conf.Metrics.Listen, "")
+	test.CheckResult(t, conf.Nagios.Hostname, "MAIL")
+	test.CheckResult(t, conf.Alertmanager.Hostname, "MAIL")
+	test.CheckResult(t, conf.Alertmanager.Timeout, 10)
+	test.CheckResult(t, conf.Zabbix.Hostname, "MAIL")
+	test.CheckResult(t, conf.Zabbix.KeyPrefix, "veloci-meter")
+	test.CheckResult(t, conf.Zabbix.Timeout, 10)
+	test.CheckResult(t, conf.Checkmk.SpoolPath, "/var/lib/check_mk_agent/spool")
+	test.CheckResult(t, conf.Checkmk.MaxAge, 30)
+	test.CheckResult(t, *conf.SendOnChange, true)
+	test.CheckResult(t, conf.RefreshInterval, 300)
+	test.CheckResult(t, *conf.Retry.Enabled, true)
+	test.CheckResult(t, conf.Retry.MaxSize, 1000)
+	test.CheckResult(t, conf.Retry.Backoff, 10)
+	test.CheckResult(t, conf.Retry.MaxBackoff, 600)
+	test.CheckResult(t, conf.Icinga.Workers, 4)
+	test.CheckResult(t, conf.Icinga.Timeout, 10)
+	test.CheckResult(t, conf.Icinga.SyncObjects, false)
+	test.CheckResult(t, conf.Icinga.CAFile, "")
+	test.CheckResult(t, conf.Icinga.TTL, 330)
 }
 
 func TestLoadConfigBrokent(t *testing.T) {
@@ -58,6 +129,7 @@ func TestLoadConfigBrokent(t *testing.T) {
 	test.CheckResult(t, conf.Mail.User, "test@local")
 	test.CheckResult(t, conf.Mail.Password, "xxxxxx")
 	test.CheckResult(t, conf.Mail.BatchSize, 5)
+	test.CheckResult(t, conf.Mail.TimestampSource, "DATE")
 	test.CheckResult(t, conf.FetchInterval, 10)
 	test.CheckResult(t, conf.CheckInterval, 10)
 	test.CheckResult(t, conf.LogLevel, "INFO")
@@ -70,6 +142,40 @@ func TestLoadConfigBrokent(t *testing.T) {
 	test.CheckResult(t, conf.Redis.URI, "localhost:6379")
 	test.CheckResult(t, conf.Redis.Password, "")
 	test.CheckResult(t, conf.Redis.Database, 0)
+	test.CheckResult(t, conf.Redis.ConnectRetries, 10)
+	test.CheckResult(t, conf.Redis.RetryBackoff, 1)
+	test.CheckResult(t, conf.Redis.MaxBackoff, 60)
+	test.CheckResult(t, conf.Redis.RecentMatches, 10)
+	test.CheckResult(t, conf.Redis.DedupRetention, 86400)
+	test.CheckResult(t, conf.Redis.Stream, "")
+	test.CheckResult(t, conf.Redis.StreamMaxLen, int64(10000))
+	test.CheckResult(t, conf.Stats.DailyRetention, 90)
+	test.CheckResult(t, conf.Stats.HourlyRetention, 48)
+	test.CheckResult(t, conf.Timezone, "UTC")
+	test.CheckResult(t, conf.Location, time.UTC)
+	test.CheckResult(t, *conf.Icinga.RecentSubjects, 3)
+	test.CheckResult(t, len(conf.Notifiers), 1)
+	test.CheckResult(t, conf.HasNotifier("icinga"), true)
+	test.CheckResult(t, conf.Metrics.Listen, "")
+	test.CheckResult(t, conf.Nagios.Hostname, "MAIL")
+	test.CheckResult(t, conf.Alertmanager.Hostname, "MAIL")
+	test.CheckResult(t, conf.Alertmanager.Timeout, 10)
+	test.CheckResult(t, conf.Zabbix.Hostname, "MAIL")
+	test.CheckResult(t, conf.Zabbix.KeyPrefix, "veloci-meter")
+	test.CheckResult(t, conf.Zabbix.Timeout, 10)
+	test.CheckResult(t, conf.Checkmk.SpoolPath, "/var/lib/check_mk_agent/spool")
+	test.CheckResult(t, conf.Checkmk.MaxAge, 30)
+	test.CheckResult(t, *conf.SendOnChange, true)
+	test.CheckResult(t, conf.RefreshInterval, 300)
+	test.CheckResult(t, *conf.Retry.Enabled, true)
+	test.CheckResult(t, conf.Retry.MaxSize, 1000)
+	test.CheckResult(t, conf.Retry.Backoff, 10)
+	test.CheckResult(t, conf.Retry.MaxBackoff, 600)
+	test.CheckResult(t, conf.Icinga.Workers, 4)
+	test.CheckResult(t, conf.Icinga.Timeout, 10)
+	test.CheckResult(t, conf.Icinga.SyncObjects, false)
+	test.CheckResult(t, conf.Icinga.CAFile, "")
+	test.CheckResult(t, conf.Icinga.TTL, 330)
 }
 
 func TestLoadConfigSyntax(t *testing.T) {
@@ -101,3 +207,17 @@ func TestLoadConfigIOError(t *testing.T) {
 	LoadConfig("config")
 	test.CheckResult(t, fatal, true)
 }
+
+func TestLoadConfigWebhook(t *testing.T) {
+	conf := LoadConfig("config.webhook.json")
+
+	test.CheckResult(t, conf.HasNotifier("icinga"), false)
+	test.CheckResult(t, conf.HasNotifier("webhook"), true)
+	test.CheckResult(t, len(conf.Webhooks), 1)
+	test.CheckResult(t, conf.Webhooks[0].URL, "https://chat.local/hooks/veloci-meter")
+	test.CheckResult(t, conf.Webhooks[0].Method, "POST")
+	test.CheckResult(t, conf.Webhooks[0].Headers["X-Source"], "veloci-meter")
+	test.CheckResult(t, conf.Webhooks[0].Timeout, 10)
+	test.CheckResult(t, *conf.Webhooks[0].Retries, 0)
+	test.CheckResult(t, conf.Webhooks[0].RetryBackoff, 1)
+}
@@ -0,0 +1,140 @@
+package icinga
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"niecke-it.de/veloci-meter/rules"
+)
+
+// ExportOptions define how the icinga configuration is generated.
+// If Freshness is set, the services are actively checked with CheckCommand if no passive result was received within Freshness seconds.
+type ExportOptions struct {
+	Hostname        string
+	HostTemplate    string
+	ServiceTemplate string
+	CheckCommand    string
+	Freshness       int
+}
+
+// duration is an interval in seconds. It is written as duration literal to the icinga2 DSL.
+type duration int
+
+// quote returns s as string literal of the icinga2 DSL.
+func quote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + s + "\""
+}
+
+// hostAttrs returns the attributes of the host in the order they are written.
+func (o *ExportOptions) hostAttrs() [][2]interface{} {
+	return [][2]interface{}{
+		{"check_command", o.CheckCommand},
+		{"enable_active_checks", false},
+		{"vars." + marker, true},
+	}
+}
+
+// serviceAttrs returns the attributes of the service for a check in the order they are written.
+func (o *ExportOptions) serviceAttrs(check rules.Check) [][2]interface{} {
+	attrs := [][2]interface{}{
+		{"host_name", o.Hostname},
+		{"check_command", o.CheckCommand},
+		{"max_check_attempts", 1},
+		{"enable_passive_checks", true},
+	}
+	if o.Freshness > 0 {
+		attrs = append(attrs,
+			[2]interface{}{"enable_active_checks", true},
+			[2]interface{}{"check_interval", duration(o.Freshness)},
+			[2]interface{}{"retry_interval", duration(o.Freshness)},
+			[2]interface{}{"vars.dummy_state", 3},
+			[2]interface{}{"vars.dummy_text", "No check result received from veloci-meter."},
+		)
+	} else {
+		attrs = append(attrs, [2]interface{}{"enable_active_checks", false})
+	}
+	return append(attrs,
+		[2]interface{}{"vars." + marker, true},
+		[2]interface{}{"vars.pattern", check.Pattern},
+	)
+}
+
+// writeObject writes an object of the icinga2 DSL.
+func writeObject(w io.Writer, kind, name, template string, attrs [][2]interface{}) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "object %s %s {\n", kind, quote(name))
+	if template != "" {
+		fmt.Fprintf(&b, "  import %s\n", quote(template))
+	}
+	for _, a := range attrs {
+		value := fmt.Sprint(a[1])
+		switch v := a[1].(type) {
+		case string:
+			value = quote(v)
+		case duration:
+			value = fmt.Sprintf("%ds", v)
+		}
+		fmt.Fprintf(&b, "  %s = %s\n", a[0], value)
+	}
+	b.WriteString("}\n\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteDSL writes the icinga2 configuration of the host and one passive service for each check.
+func WriteDSL(w io.Writer, o *ExportOptions, checks []rules.Check) error {
+	if err := writeObject(w, "Host", o.Hostname, o.HostTemplate, o.hostAttrs()); err != nil {
+		return err
+	}
+	for _, check := range checks {
+		if err := writeObject(w, "Service", check.Name, o.ServiceTemplate, o.serviceAttrs(check)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// directorObject returns an object as expected by the REST api of the icinga director.
+func directorObject(name, template string, attrs [][2]interface{}) map[string]interface{} {
+	object := map[string]interface{}{
+		"object_name": name,
+		"object_type": "object",
+	}
+	if template != "" {
+		object["imports"] = []string{template}
+	}
+	vars := map[string]interface{}{}
+	for _, a := range attrs {
+		key := a[0].(string)
+		switch {
+		case strings.HasPrefix(key, "vars."):
+			vars[strings.TrimPrefix(key, "vars.")] = a[1]
+		case key == "host_name":
+			object["host"] = a[1]
+		default:
+			object[key] = a[1]
+		}
+	}
+	object["vars"] = vars
+	return object
+}
+
+// WriteDirector writes the host and one passive service for each check as json list for the import into the icinga director.
+// Each entry is an object as accepted by the REST api of the director.
+func WriteDirector(w io.Writer, o *ExportOptions, checks []rules.Check) error {
+	objects := []map[string]interface{}{directorObject(o.Hostname, o.HostTemplate, o.hostAttrs())}
+	for _, check := range checks {
+		objects = append(objects, directorObject(check.Name, o.ServiceTemplate, o.serviceAttrs(check)))
+	}
+	b, err := json.MarshalIndent(objects, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,66 @@
+package icinga
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"niecke-it.de/veloci-meter/rules"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestQuote(t *testing.T) {
+	test.CheckResult(t, quote("say \"hi\"\\"), "\"say \\\"hi\\\"\\\\\"")
+}
+
+func TestWriteDSL(t *testing.T) {
+	var b bytes.Buffer
+	o := ExportOptions{Hostname: "MAIL", ServiceTemplate: "generic-service", CheckCommand: "dummy"}
+	err := WriteDSL(&b, &o, []rules.Check{{Name: "first rule", Pattern: "Backup"}})
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, b.String(), `object Host "MAIL" {
+  check_command = "dummy"
+  enable_active_checks = false
+  vars.veloci_meter = true
+}
+
+object Service "first rule" {
+  import "generic-service"
+  host_name = "MAIL"
+  check_command = "dummy"
+  max_check_attempts = 1
+  enable_passive_checks = true
+  enable_active_checks = false
+  vars.veloci_meter = true
+  vars.pattern = "Backup"
+}
+
+`)
+
+	b.Reset()
+	o.Freshness = 300
+	o.HostTemplate = "generic-host"
+	test.CheckResult(t, WriteDSL(&b, &o, []rules.Check{{Name: "first rule", Pattern: "Backup"}}), nil)
+	test.CheckResult(t, strings.Contains(b.String(), "  import \"generic-host\"\n"), true)
+	test.CheckResult(t, strings.Contains(b.String(), "  enable_active_checks = true\n  check_interval = 300s\n"), true)
+	test.CheckResult(t, strings.Contains(b.String(), "  vars.dummy_state = 3\n"), true)
+}
+
+func TestWriteDirector(t *testing.T) {
+	var b bytes.Buffer
+	o := ExportOptions{Hostname: "MAIL", HostTemplate: "generic-host", CheckCommand: "dummy", Freshness: 300}
+	test.CheckResult(t, WriteDirector(&b, &o, []rules.Check{{Name: "first rule", Pattern: "Backup"}}), nil)
+
+	var objects []map[string]interface{}
+	test.CheckResult(t, json.Unmarshal(b.Bytes(), &objects), nil)
+	test.CheckResult(t, len(objects), 2)
+	test.CheckResult(t, objects[0]["object_name"], "MAIL")
+	test.CheckResult(t, objects[0]["imports"].([]interface{})[0], "generic-host")
+	test.CheckResult(t, objects[1]["object_name"], "first rule")
+	test.CheckResult(t, objects[1]["object_type"], "object")
+	test.CheckResult(t, objects[1]["host"], "MAIL")
+	test.CheckResult(t, objects[1]["imports"], nil)
+	test.CheckResult(t, objects[1]["check_interval"], float64(300))
+	test.CheckResult(t, objects[1]["vars"].(map[string]interface{})["pattern"], "Backup")
+}
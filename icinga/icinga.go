@@ -2,87 +2,210 @@ package icinga
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"niecke-it.de/veloci-meter/config"
 	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/notify"
 )
 
-// SendResults send check data to the defined icinga server and logs a warning if no check definition was found on the server.
-func SendResults(c *config.Config, name, pattern string, exitCode int, count int64) {
-	l.DebugLog("Sending results.", map[string]interface{}{
-		"name":      name,
-		"pattern":   pattern,
-		"exit_code": exitCode,
-	})
-	// TODO move insecure ssl to config
+// Notifier sends check results as passive check results to the icinga api.
+type Notifier struct {
+	c      *config.Config
+	client *http.Client
+}
+
+// New returns a notifier for the icinga server defined in the config.
+// All requests share one http client, so connections to icinga are kept alive between the check runs.
+// An error is returned if the CA or the client certificate can not be loaded.
+func New(c *config.Config) (*Notifier, error) {
+	tlsConfig, err := TLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: *c.InsecureSkipVerify},
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: c.Icinga.Workers,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return &Notifier{
+		c: c,
+		client: &http.Client{
+			Timeout:   time.Duration(c.Icinga.Timeout) * time.Second,
+			Transport: tr,
+		},
+	}, nil
+}
+
+// TLSConfig returns the tls config for the connections to the icinga api.
+// The server certificate is verified against Icinga.CAFile or the system roots, and Icinga.CertFile is used for client certificate authentication.
+func TLSConfig(c *config.Config) (*tls.Config, error) {
+	t := &tls.Config{
+		InsecureSkipVerify: *c.InsecureSkipVerify,
+		ServerName:         c.Icinga.ServerName,
 	}
-	var netClient = &http.Client{
-		Timeout:   time.Second * 10,
-		Transport: tr,
+	if c.Icinga.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.Icinga.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", c.Icinga.CAFile)
+		}
+	}
+	if c.Icinga.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.Icinga.CertFile, c.Icinga.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// Notify sends all results to icinga with Icinga.Workers parallel requests. Every result is send, even if sending another one failed.
+// The first error is returned. Sending the results must not delay the next run, so all requests are cancelled after CheckInterval.
+func (n *Notifier) Notify(ctx context.Context, results []notify.Result) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(n.c.CheckInterval)*time.Second)
+	defer cancel()
+	jobs := make(chan *notify.Result)
+	errs := make(chan error, len(results))
+	var wg sync.WaitGroup
+	for i := 0; i < n.c.Icinga.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for res := range jobs {
+				if err := n.SendResult(ctx, *res); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for i := range results {
+		jobs <- &results[i]
 	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
 
-	var e = "OK"
-	if exitCode == 1 {
-		e = "WARNING"
-	} else if exitCode == 2 {
-		e = "CRITICAL"
-	}
-	var jsonStr = []byte(fmt.Sprintf(`{"type": "Service", "filter": "host.name==\"%v\" && service.name==\"%v\"", "exit_status": %d, "plugin_output": "[%v] Pattern: '%v'", "performance_data": [ "count=%d" ]}`, c.Icinga.Hostname, name, exitCode, e, pattern, count))
-	resp, err := postForm(netClient, c.Icinga.Endpoint, c.Icinga.User, c.Icinga.Password, jsonStr)
+	failed := len(errs)
+	if failed > 0 {
+		l.WarnLog("{{.failed}} of {{.count}} results could not be send to icinga.", map[string]interface{}{
+			"failed": failed,
+			"count":  len(results),
+		})
+	}
+	return <-errs
+}
+
+// SendResult send check data to the defined icinga server and logs a warning if no check definition was found on the server.
+// The subjects of recent mails are added to the plugin output as long output.
+func (n *Notifier) SendResult(ctx context.Context, res notify.Result) error {
+	c := n.c
+	l.DebugLog("Sending results.", map[string]interface{}{
+		"name":      res.Name,
+		"pattern":   res.Pattern,
+		"exit_code": int(res.State),
+	})
+
+	payload := map[string]interface{}{
+		"type":             "Service",
+		"filter":           fmt.Sprintf("host.name==\"%v\" && service.name==\"%v\"", c.Icinga.Hostname, res.Name),
+		"exit_status":      int(res.State),
+		"plugin_output":    res.Output(),
+		"performance_data": []string{res.PerfData()},
+		"check_source":     c.Icinga.CheckSource,
+		"ttl":              c.Icinga.TTL,
+	}
+	if !res.Start.IsZero() && !res.End.IsZero() {
+		payload["execution_start"] = unixTime(res.Start)
+		payload["execution_end"] = unixTime(res.End)
+	}
+	jsonStr, err := json.Marshal(payload)
+	if err != nil {
+		l.ErrorLog(err, "Error while marshaling icinga payload.", map[string]interface{}{
+			"name":    res.Name,
+			"pattern": res.Pattern,
+		})
+		return err
+	}
+	resp, err := postForm(ctx, n.client, c.Icinga.Endpoint, c.Icinga.User, c.Icinga.Password, jsonStr)
 	if err != nil {
 		l.ErrorLog(err, "There was an error sending data to icinga.", map[string]interface{}{
-			"payload": jsonStr,
+			"payload": string(jsonStr),
 		})
+		return err
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		l.ErrorLog(err, "There was an error parsing answer from icinga.", map[string]interface{}{
-			"body": resp.Body,
+			"name": res.Name,
 		})
+		return err
 	}
 	l.DebugLog("Result from icinga.", map[string]interface{}{
-		"body": body,
+		"body": string(body),
 	})
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		err = fmt.Errorf("icinga returned status %v", resp.Status)
+		l.ErrorLog(err, "Icinga did not accept the check result for {{.name}}.", map[string]interface{}{
+			"name": res.Name,
+			"body": string(body),
+		})
+		return err
+	}
 
-	// TODO print Warning when result is empty
-	var r map[string]interface{}
+	var r struct {
+		Results []interface{} `json:"results"`
+	}
 	err = json.Unmarshal(body, &r)
 	if err != nil {
 		l.ErrorLog(err, "Error while decoding icinga result. The http response body was {{.body}}", map[string]interface{}{
-			"body": body,
+			"body": string(body),
+		})
+		return err
+	}
+	if len(r.Results) == 0 {
+		l.WarnLog("No Check definition found!", map[string]interface{}{
+			"name":    res.Name,
+			"pattern": res.Pattern,
 		})
 	} else {
-		results := r["results"].([]interface{})
-		if len(results) == 0 {
-			l.WarnLog("No Check definition found!", map[string]interface{}{
-				"name":    name,
-				"pattern": pattern,
-			})
-		} else {
-			l.DebugLog("Send data for check {{.check}}", map[string]interface{}{
-				"check": results[0],
-			})
-		}
+		l.DebugLog("Send data for check {{.check}}", map[string]interface{}{
+			"check": r.Results[0],
+		})
 	}
+	return nil
+}
 
+// unixTime returns t as unix timestamp with fractional seconds as expected by the icinga api.
+func unixTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
 }
 
-func postForm(c *http.Client, url, user, password string, data []byte) (resp *http.Response, err error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+func postForm(ctx context.Context, c *http.Client, url, user, password string, data []byte) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	req.SetBasicAuth(user, password)
+	// api users authenticated by a client certificate have no password
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
 	return c.Do(req)
 }
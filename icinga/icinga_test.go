@@ -0,0 +1,111 @@
+package icinga
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestSendResult(t *testing.T) {
+	var payload map[string]interface{}
+	var user, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, _ = req.BasicAuth()
+		json.NewDecoder(req.Body).Decode(&payload)
+		w.Write([]byte(`{"results":[{"code":200,"status":"Successfully processed check result"}]}`))
+	}))
+	defer server.Close()
+
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Icinga.Endpoint = server.URL
+	n, _ := New(conf)
+
+	start := time.Unix(1600000000, 0)
+	err := n.SendResult(context.Background(), notify.Result{Name: "rule", Pattern: "Backup", State: notify.CRITICAL, Count: 4, Critical: 3,
+		Start: start, End: start.Add(500 * time.Millisecond)})
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, user, "root")
+	test.CheckResult(t, password, "xxxxxxx")
+	test.CheckResult(t, payload["filter"], "host.name==\"MAIL\" && service.name==\"rule\"")
+	test.CheckResult(t, payload["exit_status"], float64(2))
+	test.CheckResult(t, payload["plugin_output"], "[CRITICAL] Pattern: 'Backup'")
+	test.CheckResult(t, payload["performance_data"].([]interface{})[0], "count=4;0;3;0")
+	test.CheckResult(t, payload["ttl"], float64(330))
+	test.CheckResult(t, payload["check_source"], conf.Icinga.CheckSource)
+	test.CheckResult(t, payload["execution_start"], float64(1600000000))
+	test.CheckResult(t, payload["execution_end"], 1600000000.5)
+}
+
+func TestSendResultError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Icinga.Endpoint = server.URL
+	n, _ := New(conf)
+
+	err := n.Notify(context.Background(), []notify.Result{{Name: "rule"}})
+	test.CheckResult(t, err != nil, true)
+
+	// an unreachable server is reported as error
+	server.Close()
+	err = n.Notify(context.Background(), []notify.Result{{Name: "rule"}})
+	test.CheckResult(t, err != nil, true)
+}
+
+func TestNotifyParallel(t *testing.T) {
+	var mu sync.Mutex
+	names := map[string]bool{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&payload)
+		mu.Lock()
+		names[payload["filter"].(string)] = true
+		mu.Unlock()
+		w.Write([]byte(`{"results":[{"code":200}]}`))
+	}))
+	defer server.Close()
+
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Icinga.Endpoint = server.URL
+	n, _ := New(conf)
+
+	results := []notify.Result{}
+	for i := 0; i < 20; i++ {
+		results = append(results, notify.Result{Name: fmt.Sprint("rule ", i)})
+	}
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(names), 20)
+}
+
+func TestNotifyDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		select {
+		case <-req.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Icinga.Endpoint = server.URL
+	conf.CheckInterval = 1
+	n, _ := New(conf)
+
+	// the results of one run are send within the check interval
+	start := time.Now()
+	err := n.Notify(context.Background(), []notify.Result{{Name: "first"}, {Name: "second"}, {Name: "third"}, {Name: "fourth"}, {Name: "fifth"}})
+	test.CheckResult(t, err != nil, true)
+	test.CheckResult(t, time.Since(start) < 3*time.Second, true)
+}
@@ -0,0 +1,201 @@
+package icinga
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/rules"
+)
+
+// marker is the custom variable set on all objects created by veloci-meter. Only objects with this variable are removed.
+const marker = "veloci_meter"
+
+// apiURL returns the url of an api path based on Icinga.Endpoint, e.g. https://localhost:5665/v1/objects/hosts/MAIL.
+func (n *Notifier) apiURL(path string) string {
+	base := n.c.Icinga.Endpoint
+	if i := strings.Index(base, "/v1/"); i >= 0 {
+		base = base[:i]
+	}
+	return base + path
+}
+
+// objectPath returns the api path of a host or service object. The names are escaped as they may contain spaces.
+func (n *Notifier) objectPath(service string) string {
+	if service == "" {
+		return "/v1/objects/hosts/" + url.PathEscape(n.c.Icinga.Hostname)
+	}
+	return "/v1/objects/services/" + url.PathEscape(n.c.Icinga.Hostname+"!"+service)
+}
+
+// request sends a request to the icinga api and returns the status code and body of the response.
+// GET requests with a body, e.g. a filter, are send as POST with the method override header as expected by icinga.
+func (n *Notifier) request(ctx context.Context, method, path string, body interface{}) (int, []byte, error) {
+	var data []byte
+	override := ""
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return 0, nil, err
+		}
+		if method == "GET" {
+			method, override = "POST", "GET"
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, n.apiURL(path), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	if override != "" {
+		req.Header.Set("X-HTTP-Method-Override", override)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if n.c.Icinga.User != "" {
+		req.SetBasicAuth(n.c.Icinga.User, n.c.Icinga.Password)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// serviceAttrs returns the attributes of the passive service for a check.
+func serviceAttrs(check rules.Check) map[string]interface{} {
+	return map[string]interface{}{
+		"check_command":         "dummy",
+		"enable_active_checks":  false,
+		"enable_passive_checks": true,
+		"max_check_attempts":    1,
+		"vars." + marker:        true,
+		"vars.pattern":          check.Pattern,
+	}
+}
+
+// Sync creates the host and a passive service for each check in icinga. Existing services created by veloci-meter are updated,
+// an existing host and services defined otherwise are not changed. If remove is set, services created by veloci-meter for checks which do not exist anymore are deleted.
+func (n *Notifier) Sync(ctx context.Context, checks []rules.Check, remove bool) error {
+	status, body, err := n.request(ctx, "GET", n.objectPath(""), nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		attrs := map[string]interface{}{
+			"check_command":        "dummy",
+			"enable_active_checks": false,
+			"vars." + marker:       true,
+		}
+		if err := n.put(ctx, n.objectPath(""), attrs); err != nil {
+			return err
+		}
+		l.InfoLog("Created host {{.host}} in icinga.", map[string]interface{}{"host": n.c.Icinga.Hostname})
+	} else if status >= 300 {
+		return fmt.Errorf("icinga returned status %d: %s", status, body)
+	}
+
+	existing, err := n.services(ctx)
+	if err != nil {
+		return err
+	}
+	created, updated := 0, 0
+	for _, check := range checks {
+		path := n.objectPath(check.Name)
+		if own, ok := existing[check.Name]; ok && !own {
+			l.DebugLog("Service {{.service}} is not managed by veloci-meter.", map[string]interface{}{"service": check.Name})
+		} else if ok {
+			status, body, err := n.request(ctx, "POST", path, map[string]interface{}{"attrs": serviceAttrs(check)})
+			if err != nil {
+				return err
+			}
+			if status >= 300 {
+				return fmt.Errorf("updating service %v failed with status %d: %s", check.Name, status, body)
+			}
+			updated++
+		} else {
+			attrs := serviceAttrs(check)
+			attrs["host_name"] = n.c.Icinga.Hostname
+			if err := n.put(ctx, path, attrs); err != nil {
+				return err
+			}
+			created++
+		}
+		delete(existing, check.Name)
+	}
+
+	removed := 0
+	if remove {
+		for name, own := range existing {
+			if !own {
+				continue
+			}
+			status, body, err := n.request(ctx, "DELETE", n.objectPath(name)+"?cascade=1", nil)
+			if err != nil {
+				return err
+			}
+			if status >= 300 {
+				return fmt.Errorf("deleting service %v failed with status %d: %s", name, status, body)
+			}
+			removed++
+		}
+	}
+	l.InfoLog("Synced services in icinga: {{.created}} created, {{.updated}} updated, {{.removed}} removed.", map[string]interface{}{
+		"created": created,
+		"updated": updated,
+		"removed": removed,
+	})
+	return nil
+}
+
+// put creates an object with the given attributes.
+func (n *Notifier) put(ctx context.Context, path string, attrs map[string]interface{}) error {
+	status, body, err := n.request(ctx, "PUT", path, map[string]interface{}{"attrs": attrs})
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return fmt.Errorf("creating %v failed with status %d: %s", path, status, body)
+	}
+	return nil
+}
+
+// services returns the names of all services of the host and if they have been created by veloci-meter.
+func (n *Notifier) services(ctx context.Context) (map[string]bool, error) {
+	status, body, err := n.request(ctx, "GET", "/v1/objects/services", map[string]interface{}{
+		"filter": fmt.Sprintf("host.name==%q", n.c.Icinga.Hostname),
+		"attrs":  []string{"name", "vars"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return map[string]bool{}, nil
+	}
+	if status >= 300 {
+		return nil, fmt.Errorf("listing services failed with status %d: %s", status, body)
+	}
+	var r struct {
+		Results []struct {
+			Attrs struct {
+				Name string                 `json:"name"`
+				Vars map[string]interface{} `json:"vars"`
+			} `json:"attrs"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	services := map[string]bool{}
+	for _, s := range r.Results {
+		services[s.Attrs.Name] = s.Attrs.Vars[marker] == true
+	}
+	return services, nil
+}
@@ -0,0 +1,108 @@
+package icinga
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/rules"
+	"niecke-it.de/veloci-meter/test"
+)
+
+// fakeAPI is a minimal stand-in for the object endpoints of the icinga api.
+type fakeAPI struct {
+	hosts    map[string]map[string]interface{}
+	services map[string]map[string]interface{}
+	requests []string
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	method := req.Method
+	if o := req.Header.Get("X-HTTP-Method-Override"); o != "" {
+		method = o
+	}
+	f.requests = append(f.requests, method+" "+req.URL.Path)
+	var body struct {
+		Attrs map[string]interface{} `json:"attrs"`
+	}
+	json.NewDecoder(req.Body).Decode(&body)
+
+	switch {
+	case req.URL.Path == "/v1/objects/services" && method == "GET":
+		results := []interface{}{}
+		for name, attrs := range f.services {
+			vars := map[string]interface{}{"veloci_meter": attrs["vars.veloci_meter"]}
+			results = append(results, map[string]interface{}{"attrs": map[string]interface{}{"name": name, "vars": vars}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	case strings.HasPrefix(req.URL.Path, "/v1/objects/hosts/"):
+		name := strings.TrimPrefix(req.URL.Path, "/v1/objects/hosts/")
+		if method == "PUT" {
+			f.hosts[name] = body.Attrs
+		} else if f.hosts[name] == nil {
+			http.Error(w, `{"error":404}`, http.StatusNotFound)
+		}
+	case strings.HasPrefix(req.URL.Path, "/v1/objects/services/MAIL!"):
+		name := strings.TrimPrefix(req.URL.Path, "/v1/objects/services/MAIL!")
+		switch method {
+		case "PUT", "POST":
+			f.services[name] = body.Attrs
+		case "DELETE":
+			delete(f.services, name)
+		}
+	default:
+		http.Error(w, `{"error":404}`, http.StatusNotFound)
+	}
+}
+
+func TestSync(t *testing.T) {
+	api := &fakeAPI{
+		hosts: map[string]map[string]interface{}{},
+		services: map[string]map[string]interface{}{
+			"deleted rule": {"vars.veloci_meter": true},
+			"ping":         {"check_command": "ping4"},
+		},
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Icinga.Endpoint = server.URL + "/v1/actions/process-check-result"
+	n, _ := New(conf)
+
+	checks := []rules.Check{{Name: "first rule", Pattern: "Backup"}, {Name: "Global 5m", Pattern: "Global 5m"}}
+	test.CheckResult(t, n.Sync(context.Background(), checks, false), nil)
+	test.CheckResult(t, api.hosts["MAIL"]["vars.veloci_meter"], true)
+	test.CheckResult(t, api.services["first rule"]["check_command"], "dummy")
+	test.CheckResult(t, api.services["first rule"]["vars.pattern"], "Backup")
+	test.CheckResult(t, api.services["first rule"]["host_name"], "MAIL")
+	test.CheckResult(t, api.services["Global 5m"]["enable_passive_checks"], true)
+	test.CheckResult(t, api.services["deleted rule"] != nil, true)
+
+	// existing services are updated and services of deleted rules are removed
+	api.requests = nil
+	checks[0].Pattern = "Backup done"
+	test.CheckResult(t, n.Sync(context.Background(), checks, true), nil)
+	test.CheckResult(t, api.services["first rule"]["vars.pattern"], "Backup done")
+	test.CheckResult(t, api.services["deleted rule"] == nil, true)
+	test.CheckResult(t, api.services["ping"]["check_command"], "ping4")
+	for _, r := range api.requests {
+		test.CheckResult(t, strings.HasPrefix(r, "PUT"), false)
+	}
+}
+
+func TestSyncError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Icinga.Endpoint = server.URL + "/v1/actions/process-check-result"
+	n, _ := New(conf)
+	test.CheckResult(t, n.Sync(context.Background(), []rules.Check{{Name: "rule"}}, false) != nil, true)
+}
@@ -0,0 +1,111 @@
+package icinga
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+// writeClientCert creates a self signed client certificate and writes it with its key to dir.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "veloci-meter"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "icinga-tls")
+	defer os.RemoveAll(dir)
+	clientCert, certFile, keyFile := writeClientCert(t, dir)
+
+	var user string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user = req.TLS.PeerCertificates[0].Subject.CommonName
+		w.Write([]byte(`{"results":[{"code":200}]}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	conf := config.LoadConfig("../config/config.example.json")
+	*conf.InsecureSkipVerify = false
+	conf.Icinga.Endpoint = server.URL
+	conf.Icinga.User = ""
+	conf.Icinga.CAFile = caFile
+	conf.Icinga.CertFile = certFile
+	conf.Icinga.KeyFile = keyFile
+	// the certificate of the test server is issued for example.com
+	conf.Icinga.ServerName = "example.com"
+
+	n, err := New(conf)
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, n.SendResult(context.Background(), notify.Result{Name: "rule"}), nil)
+	test.CheckResult(t, user, "veloci-meter")
+
+	// the server name does not match the certificate
+	conf.Icinga.ServerName = "icinga.local"
+	n, _ = New(conf)
+	test.CheckResult(t, n.SendResult(context.Background(), notify.Result{Name: "rule"}) != nil, true)
+
+	// the server certificate can not be verified without the CA
+	conf.Icinga.ServerName = "example.com"
+	conf.Icinga.CAFile = ""
+	n, _ = New(conf)
+	test.CheckResult(t, n.SendResult(context.Background(), notify.Result{Name: "rule"}) != nil, true)
+}
+
+func TestTLSConfigError(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Icinga.CAFile = "missing.crt"
+	_, err := New(conf)
+	test.CheckResult(t, err != nil, true)
+
+	conf.Icinga.CAFile = "../config/config.example.json"
+	_, err = New(conf)
+	test.CheckResult(t, err != nil, true)
+
+	conf.Icinga.CAFile = ""
+	conf.Icinga.CertFile = "missing.crt"
+	_, err = New(conf)
+	test.CheckResult(t, err != nil, true)
+}
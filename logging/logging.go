@@ -76,7 +76,7 @@ func FatalLog(err error, msg string, fields map[string]interface{}) {
 }
 
 func fieldsWithError(err error, fields *map[string]interface{}) {
-	if fields == nil {
+	if *fields == nil {
 		*fields = map[string]interface{}{}
 	}
 	if err == nil {
@@ -15,7 +15,7 @@ type IMAPClient struct {
 }
 
 // NewIMAPClient connects to the mail server defined by the config and returns a pointer to the connected client.
-func NewIMAPClient(conf *config.Mail) *IMAPClient {
+func NewIMAPClient(conf *config.Mail) (*IMAPClient, error) {
 	l.DebugLog("Connecting to mail server...", map[string]interface{}{
 		"server_uri": conf.URI,
 	})
@@ -25,6 +25,7 @@ func NewIMAPClient(conf *config.Mail) *IMAPClient {
 		l.ErrorLog(err, "There was an error while connecting to mail server.", map[string]interface{}{
 			"server_uri": conf.URI,
 		})
+		return nil, err
 	}
 	i := IMAPClient{
 		c,
@@ -34,7 +35,7 @@ func NewIMAPClient(conf *config.Mail) *IMAPClient {
 		"server_uri": conf.URI,
 	})
 
-	return &i
+	return &i, nil
 }
 
 // MarkAsSeen marks all mails in seSeq as seen. If there are no mails in setSeq the function returns immediately.
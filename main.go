@@ -4,36 +4,45 @@ package main
 ToDo
 * warn if no icinga check definition found
 * add CleanUp run
-* add reconnect for redis
 * replace log.Fatal by Error Messages
 
 */
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/kardianos/service"
 	"github.com/robfig/cron/v3"
+	"niecke-it.de/veloci-meter/alertmanager"
 	"niecke-it.de/veloci-meter/background"
+	"niecke-it.de/veloci-meter/checkmk"
 	"niecke-it.de/veloci-meter/cleanup"
 	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/icinga"
 	l "niecke-it.de/veloci-meter/logging"
 	m "niecke-it.de/veloci-meter/mail"
+	"niecke-it.de/veloci-meter/metrics"
+	"niecke-it.de/veloci-meter/nagios"
+	"niecke-it.de/veloci-meter/notify"
 	"niecke-it.de/veloci-meter/rdb"
+	"niecke-it.de/veloci-meter/retry"
 	"niecke-it.de/veloci-meter/rules"
+	"niecke-it.de/veloci-meter/state"
 	"niecke-it.de/veloci-meter/stats"
+	"niecke-it.de/veloci-meter/webhook"
+	"niecke-it.de/veloci-meter/zabbix"
 )
 
 var logger service.Logger
 var confPath string
 var logPath string
 var conf config.Config
-var rulesList rules.Rules
 var cronJob cron.Cron
 
 // Program structures.
@@ -70,9 +79,13 @@ func (p *program) run() error {
 		l.DebugLog("Rule {{.rule_position}}: {{.rule_content}}", map[string]interface{}{"rule_position": i, "rule_content": rulesList.Rules[i].ToString()})
 	}
 
+	//##### REDIS #####
+	r := rdb.Connect(&conf.Redis, conf.Location)
+
 	//##### CRON #####
-	cronJob = *cron.New()
-	cronID, err := cronJob.AddFunc(conf.CleanUpSchedule, wrapCleanUpJob)
+	// the export job runs after midnight in the timezone of the statistics
+	cronJob = *cron.New(cron.WithLocation(conf.Location))
+	cronID, err := cronJob.AddFunc(conf.CleanUpSchedule, func() { cleanup.CleanUp(&conf, r) })
 	if err != nil {
 		l.FatalLog(err, "Error while adding cronjob.", map[string]interface{}{
 			"job_name":     "cleanUp",
@@ -86,7 +99,7 @@ func (p *program) run() error {
 		})
 	}
 	exportJobSchedule := "0 3 * * *"
-	cronID, err = cronJob.AddFunc(exportJobSchedule, wrapExportJob)
+	cronID, err = cronJob.AddFunc(exportJobSchedule, func() { stats.ExportJob(&conf, *rulesList, r) })
 	if err != nil {
 		l.FatalLog(err, "Error while adding cronjob.", map[string]interface{}{
 			"job_name":     "exportJob",
@@ -101,16 +114,30 @@ func (p *program) run() error {
 	}
 	cronJob.Start()
 
-	//##### REDIS #####
-	r := rdb.NewClient(&conf.Redis)
+	//##### METRICS #####
+	if conf.Metrics.Listen != "" {
+		go metrics.Listen(conf.Metrics.Listen)
+	}
+
+	//##### ICINGA OBJECTS #####
+	if conf.HasNotifier("icinga") && conf.Icinga.SyncObjects {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := newIcinga(&conf).Sync(ctx, rulesList.Checks(), conf.Icinga.RemoveObjects); err != nil {
+			l.ErrorLog(err, "There was an error while creating the services in icinga.", nil)
+		}
+		cancel()
+	}
 
 	// start the background process which checks key counts in redis
 	//go background.CheckRedisLimits(config, rules)
-	go background.CheckForAlerts(&conf, rulesList)
+	go background.CheckForAlerts(&conf, rulesList, r, newNotifier(&conf, r))
 
 	//##### MAIL STUFF #####
 	l.InfoLog("Check that mailboxes are setup...", nil)
-	imapClient := m.NewIMAPClient(&conf.Mail)
+	imapClient, err := m.NewIMAPClient(&conf.Mail)
+	if err != nil {
+		l.FatalLog(err, "Error while connecting to the mail server.", map[string]interface{}{"server_uri": conf.Mail.URI})
+	}
 
 	// Login
 	l.InfoLog("Loging into mail server...", nil)
@@ -159,15 +186,157 @@ func waitForChannelsToClose(ch <-chan struct{}) {
 	l.DebugLog("{{.duration}} for Cron job to stop", map[string]interface{}{"duration": time.Since(t)})
 }
 
-func wrapExportJob() {
-	stats.ExportJob(&conf, rulesList)
+// newIcinga returns the icinga notifier and exits if its tls config can not be loaded.
+func newIcinga(conf *config.Config) *icinga.Notifier {
+	n, err := icinga.New(conf)
+	if err != nil {
+		l.FatalLog(err, "The tls config for icinga can not be loaded.", map[string]interface{}{
+			"ca_file":   conf.Icinga.CAFile,
+			"cert_file": conf.Icinga.CertFile,
+		})
+	}
+	return n
 }
 
-func wrapCleanUpJob() {
-	cleanup.CleanUp(&conf)
+// newNotifier returns a notifier sending the check results to all backends enabled in the config.
+// If SendOnChange is set, the icinga, nagios, zabbix and webhook notifiers only receive changed results. The alertmanager and checkmk
+// notifiers always receive all results, as their alerts and spool files expire.
+// Failed results are queued in redis and sent again, except for alertmanager and checkmk whose results expire anyway.
+// The results are counted in the metrics when they are actually sent, not when they are filtered or queued.
+func newNotifier(conf *config.Config, r *rdb.Client) notify.Notifier {
+	n := notify.Multi{}
+	wrap := func(name string, next notify.Notifier) notify.Notifier {
+		next = notify.NewCount(name, next)
+		if *conf.Retry.Enabled {
+			next = retry.New(name, next, r.Queue(name), &conf.Retry)
+		}
+		if !*conf.SendOnChange {
+			return next
+		}
+		return notify.NewOnChange(next, time.Duration(conf.RefreshInterval)*time.Second)
+	}
+	for _, name := range conf.Notifiers {
+		switch name {
+		case "icinga":
+			n[name] = wrap(name, newIcinga(conf))
+		case "alertmanager":
+			n[name] = notify.NewCount(name, alertmanager.New(conf))
+		case "nagios":
+			n[name] = wrap(name, nagios.New(&conf.Nagios))
+		case "checkmk":
+			n[name] = notify.NewCount(name, checkmk.New(&conf.Checkmk))
+		case "zabbix":
+			n[name] = wrap(name, zabbix.New(&conf.Zabbix))
+		case "webhook":
+			for i := range conf.Webhooks {
+				w, err := webhook.New(&conf.Webhooks[i])
+				if err != nil {
+					l.FatalLog(err, "The template of webhook {{.index}} can not be parsed.", map[string]interface{}{"index": i})
+				}
+				name := fmt.Sprintf("webhook %d", i)
+				n[name] = wrap(name, w)
+			}
+		}
+	}
+	return n
+}
+
+// runStateCommand exports or imports the state of veloci-meter in redis.
+// Usage: veloci-meter state export|import [-config path] <file>
+func runStateCommand(args []string) {
+	usage := "Usage: veloci-meter state export|import [-config path] <file>"
+	fs := flag.NewFlagSet("state", flag.ExitOnError)
+	configPath := fs.String("config", "/opt/veloci-meter/config.json", "Path of the config file.")
+	if len(args) < 1 {
+		log.Fatal(usage)
+	}
+	if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 1 {
+		log.Fatal(usage)
+	}
+	c := config.LoadConfig(*configPath)
+
+	var err error
+	switch args[0] {
+	case "export":
+		err = state.Export(c, fs.Arg(0))
+	case "import":
+		err = state.Import(c, fs.Arg(0))
+	default:
+		log.Fatal(usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runCheckmkCommand prints the current state of all rules as checkmk local checks.
+func runCheckmkCommand(args []string) {
+	fs := flag.NewFlagSet("checkmk", flag.ExitOnError)
+	configPath := fs.String("config", "/opt/veloci-meter/config.json", "Path of the config file.")
+	rulesPath := fs.String("rules", "/opt/veloci-meter/rules.json", "Path of the rules file.")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		log.Fatal("Usage: veloci-meter checkmk [-config path] [-rules path]")
+	}
+	c := config.LoadConfig(*configPath)
+	rulesList := rules.LoadRules(*rulesPath)
+	// the agent waits for the command, so redis is only tried once
+	r := rdb.NewClient(&c.Redis, c.Location)
+	results := background.Unknown(rulesList)
+	if r.Healthy() {
+		results = background.Evaluate(c, rulesList, r)
+	}
+	if err := checkmk.Write(os.Stdout, results); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runExportIcingaCommand prints the icinga configuration of the host and the services for all rules.
+func runExportIcingaCommand(args []string) {
+	usage := "Usage: veloci-meter export-icinga [-config path] [-rules path] [-format dsl|director] [-host-template name] [-service-template name] [-check-command name] [-freshness seconds]"
+	fs := flag.NewFlagSet("export-icinga", flag.ExitOnError)
+	configPath := fs.String("config", "/opt/veloci-meter/config.json", "Path of the config file.")
+	rulesPath := fs.String("rules", "/opt/veloci-meter/rules.json", "Path of the rules file.")
+	format := fs.String("format", "dsl", "Output format: dsl for the icinga2 config or director for a json import into the icinga director.")
+	o := icinga.ExportOptions{}
+	fs.StringVar(&o.HostTemplate, "host-template", "", "Template imported by the host.")
+	fs.StringVar(&o.ServiceTemplate, "service-template", "", "Template imported by the services.")
+	fs.StringVar(&o.CheckCommand, "check-command", "dummy", "Check command of the host and the services.")
+	fs.IntVar(&o.Freshness, "freshness", 0, "Number of seconds after which a service without passive check result is set to UNKNOWN. Disabled if 0.")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		log.Fatal(usage)
+	}
+	c := config.LoadConfig(*configPath)
+	o.Hostname = c.Icinga.Hostname
+	checks := rules.LoadRules(*rulesPath).Checks()
+
+	var err error
+	switch *format {
+	case "dsl":
+		err = icinga.WriteDSL(os.Stdout, &o, checks)
+	case "director":
+		err = icinga.WriteDirector(os.Stdout, &o, checks)
+	default:
+		log.Fatal(usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		runStateCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "checkmk" {
+		runCheckmkCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-icinga" {
+		runExportIcingaCommand(os.Args[2:])
+		return
+	}
+
 	if len(os.Args) == 3 {
 		confPath = os.Args[1]
 		logPath = os.Args[1]
@@ -228,19 +397,29 @@ func main() {
 
 func fetchMails(config *config.Config, rules *rules.Rules, r *rdb.Client) {
 	l.DebugLog("Running main process loop...", nil)
-	startTimestamp := int(time.Now().Unix())
+	start := time.Now()
+	startTimestamp := int(start.Unix())
 	//##### MAIL STUFF #####
-	imapClient := m.NewIMAPClient(&config.Mail)
+	imapClient, err := m.NewIMAPClient(&config.Mail)
+	if err != nil {
+		fetchFailed(config, err, "There was an error while connecting to the mail server.")
+		return
+	}
 
 	// Login
 	if err := imapClient.Login(config.Mail.User, config.Mail.Password); err != nil {
-		l.FatalLog(err, "There was an error while logging into mailbox.", map[string]interface{}{"mail_user": config.Mail.User})
+		imapClient.Terminate()
+		fetchFailed(config, err, "There was an error while logging into mailbox.")
+		return
 	}
 	l.DebugLog("Logged in", nil)
 
 	// Select INBOX
 	if _, err := imapClient.Select("INBOX", false); err != nil {
-		l.FatalLog(err, "There was an error selecting INBOX.", nil)
+		imapClient.Logout()
+		imapClient.Terminate()
+		fetchFailed(config, err, "There was an error selecting INBOX.")
+		return
 	}
 
 	//##### PROCESS MAILS #####
@@ -261,42 +440,26 @@ func fetchMails(config *config.Config, rules *rules.Rules, r *rdb.Client) {
 		done := make(chan error, 1)
 		l.DebugLog("Messages will be processed.", map[string]interface{}{"unseen_mails": unseenMails})
 		go func() {
-			done <- imapClient.Fetch(unseenMails, []imap.FetchItem{imap.FetchEnvelope}, messages)
+			done <- imapClient.Fetch(unseenMails, []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchInternalDate}, messages)
 		}()
 
-		unknown := new(imap.SeqSet)
-		known := new(imap.SeqSet)
-
+		msgs := []*imap.Message{}
 		for msg := range messages {
-			found := false
-			processed++
-			for _, rule := range rules.Rules {
-				if contains := strings.Contains(msg.Envelope.Subject, rule.Pattern); contains == true {
-					r.StoreMail(msg, rule.Timeframe)
-					r.IncreaseStatisticCountMail(rule.Name)
-					known.AddNum(msg.SeqNum)
-					found = true
-					break
-				}
-			}
-			if found == false {
-				l.DebugLog("Subject '{{.message_subject}}' does not match any pattern.", map[string]interface{}{"message_subject": msg.Envelope.Subject})
-				// increment the global counters for unknown mails
-				r.IncreaseGlobalCounter(5)
-				r.IncreaseStatisticCountMail("Global 5m")
-				l.DebugLog("Increment global counter 5 minutes by 1.", nil)
-
-				r.IncreaseGlobalCounter(60)
-				r.IncreaseStatisticCountMail("Global 60m")
-				l.DebugLog("Increment global counter 60 minutes by 1.", nil)
-				unknown.AddNum(msg.SeqNum)
-			}
+			msgs = append(msgs, msg)
 		}
-		imapClient.MarkAsSeen(known)
-		imapClient.MoveToTODO(unknown)
-
 		if err := <-done; err != nil {
-			l.FatalLog(err, "Unknown error!", nil)
+			// the mails stay unseen and are fetched again in the next run
+			metrics.FetchErrors.Inc()
+			l.ErrorLog(err, "There was an error while fetching mails.", map[string]interface{}{"unseen_mails": unseenMails})
+		} else {
+			processed = len(msgs)
+
+			// if the batch could not be stored all mails stay unseen and are processed again in the next run
+			known, unknown, err := processMails(config, rules, r, msgs)
+			if err == nil {
+				imapClient.MarkAsSeen(known)
+				imapClient.MoveToTODO(unknown)
+			}
 		}
 	} else {
 		l.DebugLog("No new messages found.", nil)
@@ -309,8 +472,110 @@ func fetchMails(config *config.Config, rules *rules.Rules, r *rdb.Client) {
 		l.ErrorLog(err, "Unknown error while terminating imap client.", nil)
 	}
 
+	metrics.FetchDuration.Observe(time.Since(start).Seconds())
 	endTimestamp := int(time.Now().Unix())
 	duration := endTimestamp - startTimestamp
 	l.InfoLog("{{.processed}} of {{.count}} messages have been processed in {{.duration}} seconds. Next run in {{.fetch_interval}} seconds", map[string]interface{}{"processed": processed, "count": len(ids), "duration": duration, "fetch_interval": conf.FetchInterval})
 	time.Sleep(time.Duration(config.FetchInterval) * time.Second)
 }
+
+// fetchFailed counts a failed connection to the mail server and waits for the next run. The mails stay unseen and are fetched again.
+func fetchFailed(config *config.Config, err error, msg string) {
+	metrics.FetchErrors.Inc()
+	l.ErrorLog(err, msg+" Retrying in {{.fetch_interval}} seconds.", map[string]interface{}{
+		"mail_user":      config.Mail.User,
+		"fetch_interval": config.FetchInterval,
+	})
+	time.Sleep(time.Duration(config.FetchInterval) * time.Second)
+}
+
+// mailTimestamp returns the time used to place a mail in the time windows of the rules based on Mail.TimestampSource.
+// If the mail has no such timestamp or it lies in the future the actual time is used.
+func mailTimestamp(conf *config.Mail, msg *imap.Message) time.Time {
+	now := time.Now()
+	ts := now
+	switch conf.TimestampSource {
+	case "DATE":
+		ts = msg.Envelope.Date
+	case "INTERNALDATE":
+		ts = msg.InternalDate
+	}
+	if ts.IsZero() || ts.After(now) {
+		return now
+	}
+	return ts
+}
+
+// processMails counts all mails which have not been counted before with a single redis transaction.
+// It returns the mails matching a rule and the unknown mails. If the transaction fails an error is returned.
+func processMails(config *config.Config, rules *rules.Rules, r *rdb.Client, msgs []*imap.Message) (*imap.SeqSet, *imap.SeqSet, error) {
+	unknown := new(imap.SeqSet)
+	known := new(imap.SeqSet)
+
+	// the number of newly counted mails per rule name and of unknown mails
+	claimed := map[string]int{}
+	claimedUnknown := 0
+	batch := r.NewBatch()
+	if err := batch.Prepare(msgs); err != nil {
+		return known, unknown, err
+	}
+	for _, msg := range msgs {
+		rule := rules.Match(msg.Envelope.Subject)
+		if batch.Claim(msg) {
+			storeMail(batch, rule, msg, mailTimestamp(&config.Mail, msg))
+			if rule != nil {
+				claimed[rule.Name]++
+			} else {
+				claimedUnknown++
+			}
+		} else {
+			l.DebugLog("Mail '{{.message_subject}}' has already been counted.", map[string]interface{}{
+				"message_subject": msg.Envelope.Subject,
+				"message_id":      msg.Envelope.MessageId})
+		}
+
+		if rule != nil {
+			known.AddNum(msg.SeqNum)
+		} else {
+			unknown.AddNum(msg.SeqNum)
+		}
+	}
+
+	start := time.Now()
+	if err := batch.Exec(); err != nil {
+		return known, unknown, err
+	}
+	for name, count := range claimed {
+		metrics.MailsProcessed.WithLabelValues(name).Add(float64(count))
+	}
+	metrics.MailsUnknown.Add(float64(claimedUnknown))
+	l.InfoLog("Stored {{.mail_count}} mails with {{.write_count}} writes in redis in {{.duration}}.", map[string]interface{}{
+		"mail_count":  len(msgs),
+		"write_count": batch.Len(),
+		"duration":    time.Since(start)})
+	return known, unknown, nil
+}
+
+// storeMail counts a mail received at ts for the rule it matches. If the mail does not match any rule the global counters are increased.
+func storeMail(b *rdb.Batch, rule *rules.Rule, msg *imap.Message, ts time.Time) {
+	if rule != nil {
+		b.PublishEvent(rule.Name, msg, ts)
+		b.StoreMail(rule.ID(), msg, rule.Timeframe, ts)
+		m := rdb.NewMatch(msg, "INBOX")
+		m.Timestamp = ts
+		b.StoreMatch(rule.ID(), m, rule.Timeframe)
+		b.IncreaseStatisticCountMail(rule.Name)
+		return
+	}
+
+	l.DebugLog("Subject '{{.message_subject}}' does not match any pattern.", map[string]interface{}{"message_subject": msg.Envelope.Subject})
+	b.PublishEvent(rules.Unknown, msg, ts)
+	// increment the global counters for unknown mails
+	b.IncreaseGlobalCounter(5, ts)
+	b.IncreaseStatisticCountMail("Global 5m")
+	l.DebugLog("Increment global counter 5 minutes by 1.", nil)
+
+	b.IncreaseGlobalCounter(60, ts)
+	b.IncreaseStatisticCountMail("Global 60m")
+	l.DebugLog("Increment global counter 60 minutes by 1.", nil)
+}
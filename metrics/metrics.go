@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	l "niecke-it.de/veloci-meter/logging"
+)
+
+const namespace = "veloci_meter"
+
+var (
+	// RuleCount is the number of mails in the current window of each rule.
+	RuleCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rule_count",
+		Help:      "Number of mails in the current window of the rule.",
+	}, []string{"rule"})
+
+	// RuleState is the last checked state of each rule (0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN).
+	RuleState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rule_state",
+		Help:      "State of the rule: 0 OK, 1 WARNING, 2 CRITICAL, 3 UNKNOWN.",
+	}, []string{"rule"})
+
+	// RuleThreshold are the ok, warning and critical thresholds of each rule.
+	RuleThreshold = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rule_threshold",
+		Help:      "Thresholds of the rule. Thresholds which are not set are not exported.",
+	}, []string{"rule", "threshold"})
+
+	// GlobalCount is the number of unknown mails in the current global windows.
+	GlobalCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "global_count",
+		Help:      "Number of unknown mails in the current global window.",
+	}, []string{"window"})
+
+	// MailsProcessed counts the processed mails matching a rule.
+	MailsProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mails_processed_total",
+		Help:      "Number of processed mails matching a rule.",
+	}, []string{"rule"})
+
+	// MailsUnknown counts the processed mails not matching any rule.
+	MailsUnknown = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mails_unknown_total",
+		Help:      "Number of processed mails not matching any rule.",
+	})
+
+	// FetchDuration observes the duration of fetching and processing one batch of mails.
+	FetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "imap_fetch_duration_seconds",
+		Help:      "Duration of fetching and processing one batch of mails.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	})
+
+	// FetchErrors counts failed fetches from the mail server.
+	FetchErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "imap_fetch_errors_total",
+		Help:      "Number of failed fetches from the mail server.",
+	})
+
+	// BatchDuration observes the time to store the writes for a batch of mails in redis.
+	BatchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_batch_duration_seconds",
+		Help:      "Duration of storing a batch of mails in redis.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	})
+
+	// RedisErrors counts failed redis commands.
+	RedisErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "Number of failed redis commands.",
+	})
+
+	// NotifierResults counts the check results send by each notifier by outcome (success or error).
+	NotifierResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifier_results_total",
+		Help:      "Number of check results send by the notifier by outcome.",
+	}, []string{"notifier", "result"})
+
+	// RetryQueueLength is the number of results waiting to be sent again by notifier.
+	RetryQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retry_queue_length",
+		Help:      "Number of results waiting to be sent again.",
+	}, []string{"notifier"})
+
+	// RetryDropped counts the results dropped because the retry queue was full.
+	RetryDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retry_dropped_total",
+		Help:      "Number of results dropped because the retry queue was full.",
+	}, []string{"notifier"})
+)
+
+// Listen serves the metrics at /metrics on the given address. It blocks until the server fails.
+func Listen(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	l.InfoLog("Serving metrics on {{.address}}.", map[string]interface{}{"address": addr})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		l.ErrorLog(err, "The metrics server on {{.address}} stopped.", map[string]interface{}{"address": addr})
+	}
+}
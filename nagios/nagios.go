@@ -0,0 +1,150 @@
+package nagios
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/notify"
+)
+
+// Notifier writes check results as PROCESS_SERVICE_CHECK_RESULT commands to the external command file of nagios or icinga
+// and optionally as check result files to the check result spool directory.
+type Notifier struct {
+	c *config.Nagios
+}
+
+// New returns a notifier for the command file and spool directory defined in the config.
+func New(c *config.Nagios) *Notifier {
+	return &Notifier{c: c}
+}
+
+// Notify writes all results to the command file and the spool directory.
+func (n *Notifier) Notify(ctx context.Context, results []notify.Result) error {
+	now := time.Now()
+	if n.c.CommandFile != "" {
+		if err := n.writeCommands(results, now); err != nil {
+			l.ErrorLog(err, "There was an error writing to the command file {{.path}}.", map[string]interface{}{
+				"path": n.c.CommandFile,
+			})
+			return err
+		}
+	}
+	if n.c.CheckResultPath != "" {
+		if err := n.writeCheckResults(results, now); err != nil {
+			l.ErrorLog(err, "There was an error writing to the check result directory {{.path}}.", map[string]interface{}{
+				"path": n.c.CheckResultPath,
+			})
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCommands writes one command per result. The command file is usually a named pipe, so it is not created.
+// Each command is written separately to keep the writes smaller than the atomic write size of a pipe.
+func (n *Notifier) writeCommands(results []notify.Result, now time.Time) error {
+	f, err := os.OpenFile(n.c.CommandFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i := range results {
+		if _, err := f.WriteString(Command(n.c.Hostname, &results[i], now)); err != nil {
+			return err
+		}
+	}
+	l.DebugLog("Wrote {{.count}} commands to {{.path}}.", map[string]interface{}{
+		"count": len(results),
+		"path":  n.c.CommandFile,
+	})
+	return nil
+}
+
+// Command returns the PROCESS_SERVICE_CHECK_RESULT command for a result including the trailing newline.
+func Command(host string, res *notify.Result, now time.Time) string {
+	return fmt.Sprintf("[%d] PROCESS_SERVICE_CHECK_RESULT;%s;%s;%d;%s\n", now.Unix(), host, res.Name, int(res.State), pluginOutput(res))
+}
+
+// pluginOutput returns the output with the performance data. Newlines of the long output are escaped, as the output has to fit in a single line.
+func pluginOutput(res *notify.Result) string {
+	output := strings.Replace(res.Output(), "\n", "\\n", -1)
+	return output + "|" + res.PerfData()
+}
+
+// writeCheckResults writes all results to a single check result file.
+// The file is written with a temporary name and renamed to the 7 character name expected by nagios afterwards.
+// Finally the .ok file signals nagios that the file is complete.
+func (n *Notifier) writeCheckResults(results []notify.Result, now time.Time) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Passive Check Result File ###\nfile_time=%d\n\n", now.Unix())
+	for i := range results {
+		res := &results[i]
+		fmt.Fprintf(&b, "### veloci-meter Check Result ###\n")
+		fmt.Fprintf(&b, "host_name=%s\n", n.c.Hostname)
+		fmt.Fprintf(&b, "service_description=%s\n", res.Name)
+		fmt.Fprintf(&b, "check_type=1\ncheck_options=0\nscheduled_check=0\nreschedule_check=0\nlatency=0.0\n")
+		fmt.Fprintf(&b, "start_time=%d.0\nfinish_time=%d.0\n", now.Unix(), now.Unix())
+		fmt.Fprintf(&b, "early_timeout=0\nexited_ok=1\n")
+		fmt.Fprintf(&b, "return_code=%d\n", int(res.State))
+		fmt.Fprintf(&b, "output=%s\n\n", pluginOutput(res))
+	}
+
+	tmp, err := ioutil.TempFile(n.c.CheckResultPath, ".veloci-meter")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	path, err := linkCheckResult(tmp.Name(), n.c.CheckResultPath)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".ok", nil, 0644); err != nil {
+		return err
+	}
+	l.DebugLog("Wrote {{.count}} check results to {{.path}}.", map[string]interface{}{
+		"count": len(results),
+		"path":  path,
+	})
+	return nil
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// linkCheckResult links the file tmp to an unused path in dir and returns the path. The name starts with c followed by 6 random characters.
+// Since a link is never created over an existing file, a name taken in the meantime is not replaced.
+func linkCheckResult(tmp string, dir string) (string, error) {
+	for i := 0; i < 100; i++ {
+		name := []byte("c000000")
+		if _, err := rand.Read(name[1:]); err != nil {
+			return "", err
+		}
+		for j := 1; j < len(name); j++ {
+			name[j] = letters[int(name[j])%len(letters)]
+		}
+		path := filepath.Join(dir, string(name))
+		err := os.Link(tmp, path)
+		if err == nil {
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no unused check result file name found in %v", dir)
+}
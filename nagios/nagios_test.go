@@ -0,0 +1,61 @@
+package nagios
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestCommand(t *testing.T) {
+	res := notify.Result{Name: "rule", Pattern: "Backup", State: notify.WARNING, Count: 3, Recent: []string{"Backup failed"}}
+	cmd := Command("MAIL", &res, time.Unix(1606003200, 0))
+	test.CheckResult(t, cmd, "[1606003200] PROCESS_SERVICE_CHECK_RESULT;MAIL;rule;1;[WARNING] Pattern: 'Backup'\\nRecent mails:\\nBackup failed|count=3;0;0;0\n")
+}
+
+func TestNotifyCommandFile(t *testing.T) {
+	f, _ := ioutil.TempFile("", "nagios.cmd")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	n := New(&config.Nagios{CommandFile: f.Name(), Hostname: "MAIL"})
+	results := []notify.Result{{Name: "first", State: notify.OK}, {Name: "second", State: notify.CRITICAL}}
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+
+	b, _ := ioutil.ReadFile(f.Name())
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	test.CheckResult(t, len(lines), 2)
+	test.CheckResult(t, strings.Contains(lines[1], "PROCESS_SERVICE_CHECK_RESULT;MAIL;second;2;"), true)
+
+	// the command file is not created if it does not exist
+	n = New(&config.Nagios{CommandFile: f.Name() + ".missing", Hostname: "MAIL"})
+	test.CheckResult(t, n.Notify(context.Background(), results) != nil, true)
+}
+
+func TestNotifyCheckResultPath(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "checkresults")
+	defer os.RemoveAll(dir)
+
+	n := New(&config.Nagios{CheckResultPath: dir, Hostname: "MAIL"})
+	results := []notify.Result{{Name: "first", State: notify.OK}, {Name: "second", State: notify.CRITICAL}}
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	test.CheckResult(t, len(files), 2)
+	name := filepath.Base(files[0])
+	test.CheckResult(t, len(name), 7)
+	test.CheckResult(t, name[0], byte('c'))
+	test.CheckResult(t, files[1], files[0]+".ok")
+
+	b, _ := ioutil.ReadFile(files[0])
+	test.CheckResult(t, strings.Count(string(b), "host_name=MAIL\n"), 2)
+	test.CheckResult(t, strings.Contains(string(b), "service_description=second\ncheck_type=1\n"), true)
+	test.CheckResult(t, strings.Contains(string(b), "return_code=2\n"), true)
+}
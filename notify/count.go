@@ -0,0 +1,30 @@
+package notify
+
+import (
+	"context"
+
+	"niecke-it.de/veloci-meter/metrics"
+)
+
+// Count counts the results sent by the wrapped notifier in the metrics.
+// It wraps the notifier sending the results, so results filtered or queued by other wrappers are not counted.
+type Count struct {
+	name string
+	next Notifier
+}
+
+// NewCount wraps the notifier n, name identifies the notifier in the metrics.
+func NewCount(name string, n Notifier) *Count {
+	return &Count{name: name, next: n}
+}
+
+// Notify sends the results and counts them as success or, if the notifier failed, as error.
+func (c *Count) Notify(ctx context.Context, results []Result) error {
+	err := c.next.Notify(ctx, results)
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	metrics.NotifierResults.WithLabelValues(c.name, result).Add(float64(len(results)))
+	return err
+}
@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"niecke-it.de/veloci-meter/metrics"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestCount(t *testing.T) {
+	metrics.NotifierResults.Reset()
+	r := &recorder{}
+	c := NewCount("counted", r)
+	results := []Result{{Name: "first"}, {Name: "second"}}
+
+	test.CheckResult(t, c.Notify(context.Background(), results), nil)
+	test.CheckResult(t, testutil.ToFloat64(metrics.NotifierResults.WithLabelValues("counted", "success")), float64(2))
+
+	r.err = errors.New("failed")
+	test.CheckResult(t, c.Notify(context.Background(), results[:1]), r.err)
+	test.CheckResult(t, testutil.ToFloat64(metrics.NotifierResults.WithLabelValues("counted", "error")), float64(1))
+
+	// results filtered by an outer wrapper are not counted
+	o := NewOnChange(c, time.Hour)
+	r.err = nil
+	o.Notify(context.Background(), results)
+	o.Notify(context.Background(), results)
+	test.CheckResult(t, testutil.ToFloat64(metrics.NotifierResults.WithLabelValues("counted", "success")), float64(4))
+}
@@ -0,0 +1,121 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	l "niecke-it.de/veloci-meter/logging"
+)
+
+// State is the state of a checked rule. The values match the exit codes of monitoring plugins.
+type State int
+
+const (
+	OK State = iota
+	WARNING
+	CRITICAL
+	UNKNOWN
+)
+
+// String returns the name of the state as used in plugin outputs.
+func (s State) String() string {
+	switch s {
+	case OK:
+		return "OK"
+	case WARNING:
+		return "WARNING"
+	case CRITICAL:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Result is the outcome of checking a single rule or global window.
+// Warning, Critical and Ok are the thresholds of the rule. Ok is only set for positive rules, which have no warning and critical threshold.
+// A negative threshold is not set, e.g. the critical threshold of the global windows.
+// Start and End are the times the check started and ended. They are zero if unknown.
+type Result struct {
+	Name     string
+	Pattern  string
+	State    State
+	Count    int64
+	Warning  int64
+	Critical int64
+	Ok       int64
+	Recent   []string
+	Start    time.Time
+	End      time.Time
+}
+
+// Output returns the plugin output for the result.
+// The subjects of recent mails are added as long output.
+func (r *Result) Output() string {
+	output := fmt.Sprintf("[%v] Pattern: '%v'", r.State, r.Pattern)
+	if len(r.Recent) > 0 {
+		output += "\nRecent mails:"
+		for _, subject := range r.Recent {
+			output += "\n" + subject
+		}
+	}
+	// a pipe separates the output from the performance data in the plugin output of nagios and icinga
+	return strings.ReplaceAll(output, "|", "¦")
+}
+
+// PerfData returns the count as performance data with the warning and critical thresholds, e.g. count=3;2;5;0.
+// Thresholds which are not set and the thresholds of positive rules are left empty.
+func (r *Result) PerfData() string {
+	if r.Ok != 0 {
+		return fmt.Sprintf("count=%d;;;0", r.Count)
+	}
+	return fmt.Sprintf("count=%d;%s;%s;0", r.Count, threshold(r.Warning), threshold(r.Critical))
+}
+
+func threshold(t int64) string {
+	if t < 0 {
+		return ""
+	}
+	return fmt.Sprint(t)
+}
+
+// Notifier sends the results of one check cycle to a monitoring backend.
+type Notifier interface {
+	Notify(ctx context.Context, results []Result) error
+}
+
+// Multi sends the results to several notifiers.
+// The notifiers run concurrently, so a slow notifier does not delay the others.
+// A failing notifier does not stop the others, the first error is returned.
+type Multi map[string]Notifier
+
+// Notify sends the results to all notifiers and waits until all are done.
+// The notifiers must not modify the results.
+func (m Multi) Notify(ctx context.Context, results []Result) error {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	for name, n := range m {
+		wg.Add(1)
+		go func(name string, n Notifier) {
+			defer wg.Done()
+			if err := n.Notify(ctx, results); err != nil {
+				l.ErrorLog(err, "Notifier {{.notifier}} failed to send {{.count}} results.", map[string]interface{}{
+					"notifier": name,
+					"count":    len(results),
+				})
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}(name, n)
+	}
+	wg.Wait()
+	return first
+}
@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/test"
+)
+
+type recorder struct {
+	results []Result
+	err     error
+}
+
+func (r *recorder) Notify(ctx context.Context, results []Result) error {
+	r.results = append(r.results, results...)
+	return r.err
+}
+
+func TestStateString(t *testing.T) {
+	test.CheckResult(t, OK.String(), "OK")
+	test.CheckResult(t, WARNING.String(), "WARNING")
+	test.CheckResult(t, CRITICAL.String(), "CRITICAL")
+	test.CheckResult(t, UNKNOWN.String(), "UNKNOWN")
+	test.CheckResult(t, State(7).String(), "UNKNOWN")
+}
+
+func TestOutput(t *testing.T) {
+	r := Result{Name: "rule", Pattern: "Backup", State: WARNING}
+	test.CheckResult(t, r.Output(), "[WARNING] Pattern: 'Backup'")
+
+	r.Recent = []string{"Backup failed", "Backup done"}
+	test.CheckResult(t, r.Output(), "[WARNING] Pattern: 'Backup'\nRecent mails:\nBackup failed\nBackup done")
+
+	// pipes are replaced, so the output is not taken for performance data
+	r = Result{Name: "rule", Pattern: "Backup|Restore", State: OK, Recent: []string{"Backup | done"}}
+	test.CheckResult(t, r.Output(), "[OK] Pattern: 'Backup¦Restore'\nRecent mails:\nBackup ¦ done")
+}
+
+func TestPerfData(t *testing.T) {
+	r := Result{Name: "rule", Count: 3, Warning: 2, Critical: 5}
+	test.CheckResult(t, r.PerfData(), "count=3;2;5;0")
+
+	// a warning threshold of 0 is a threshold
+	r = Result{Name: "rule", Count: 1, Warning: 0, Critical: 5}
+	test.CheckResult(t, r.PerfData(), "count=1;0;5;0")
+
+	r = Result{Name: "positive rule", Count: 1, Ok: 1}
+	test.CheckResult(t, r.PerfData(), "count=1;;;0")
+
+	r = Result{Name: "Global 5m", Count: 1, Warning: 100, Critical: -1}
+	test.CheckResult(t, r.PerfData(), "count=1;100;;0")
+}
+
+func TestMulti(t *testing.T) {
+	failing := &recorder{err: errors.New("failed")}
+	working := &recorder{}
+	m := Multi{"failing": failing, "working": working}
+
+	err := m.Notify(context.Background(), []Result{{Name: "rule"}})
+	test.CheckResult(t, err, failing.err)
+	test.CheckResult(t, len(failing.results), 1)
+	test.CheckResult(t, len(working.results), 1)
+	test.CheckResult(t, working.results[0].Name, "rule")
+}
+
+type notifierFunc func(ctx context.Context, results []Result) error
+
+func (f notifierFunc) Notify(ctx context.Context, results []Result) error {
+	return f(ctx, results)
+}
+
+func TestMultiConcurrent(t *testing.T) {
+	called := make(chan struct{})
+	m := Multi{
+		"waiting": notifierFunc(func(ctx context.Context, results []Result) error {
+			select {
+			case <-called:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}),
+		"working": notifierFunc(func(ctx context.Context, results []Result) error {
+			close(called)
+			return nil
+		}),
+	}
+
+	// the waiting notifier only returns in time if the notifiers run concurrently
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	test.CheckResult(t, m.Notify(ctx, []Result{{Name: "rule"}}), nil)
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	l "niecke-it.de/veloci-meter/logging"
+)
+
+type sent struct {
+	state State
+	at    time.Time
+}
+
+// OnChange passes only those results to the wrapped notifier whose state changed since they were last sent.
+// Unchanged results are sent again after the refresh interval, e.g. to keep passive checks fresh.
+type OnChange struct {
+	next    Notifier
+	refresh time.Duration
+
+	mu   sync.Mutex
+	last map[string]sent
+}
+
+// NewOnChange wraps the notifier n.
+func NewOnChange(n Notifier, refresh time.Duration) *OnChange {
+	return &OnChange{next: n, refresh: refresh, last: map[string]sent{}}
+}
+
+// Notify sends the changed and outdated results. If the wrapped notifier fails, the results are sent again in the next run.
+func (o *OnChange) Notify(ctx context.Context, results []Result) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	changed := make([]Result, 0, len(results))
+	for _, res := range results {
+		if last, ok := o.last[res.Name]; ok && last.state == res.State && now.Sub(last.at) < o.refresh {
+			continue
+		}
+		changed = append(changed, res)
+	}
+	l.DebugLog("{{.count}} of {{.total}} results changed or need a refresh.", map[string]interface{}{
+		"count": len(changed),
+		"total": len(results),
+	})
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := o.next.Notify(ctx, changed); err != nil {
+		for _, res := range changed {
+			delete(o.last, res.Name)
+		}
+		return err
+	}
+	for _, res := range changed {
+		o.last[res.Name] = sent{state: res.State, at: now}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestOnChange(t *testing.T) {
+	r := &recorder{}
+	o := NewOnChange(r, time.Hour)
+	results := []Result{{Name: "first", State: OK}, {Name: "second", State: OK}}
+
+	test.CheckResult(t, o.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(r.results), 2)
+
+	// unchanged results are not sent again
+	r.results = nil
+	test.CheckResult(t, o.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(r.results), 0)
+
+	results[1].State = CRITICAL
+	test.CheckResult(t, o.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(r.results), 1)
+	test.CheckResult(t, r.results[0].Name, "second")
+
+	// failed results are sent again
+	r.results = nil
+	r.err = errors.New("failed")
+	results[0].State = WARNING
+	test.CheckResult(t, o.Notify(context.Background(), results), r.err)
+	r.results = nil
+	r.err = nil
+	test.CheckResult(t, o.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(r.results), 1)
+	test.CheckResult(t, r.results[0].Name, "first")
+}
+
+func TestOnChangeRefresh(t *testing.T) {
+	r := &recorder{}
+	o := NewOnChange(r, 0)
+	results := []Result{{Name: "first", State: OK}}
+
+	test.CheckResult(t, o.Notify(context.Background(), results), nil)
+	test.CheckResult(t, o.Notify(context.Background(), results), nil)
+	test.CheckResult(t, len(r.results), 2)
+}
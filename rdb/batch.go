@@ -0,0 +1,239 @@
+package rdb
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/go-redis/redis"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/metrics"
+)
+
+// ErrClaimed is returned by Batch.Exec if another process counted one of the claimed mails since Prepare.
+var ErrClaimed = errors.New("mail was already counted by another process")
+
+// Batch collects the writes for a batch of mails and sends them to redis in a single MULTI/EXEC transaction.
+// The keys of the claimed mails are watched, so the transaction is not executed if another process counted one of the mails in the meantime.
+// A batch which was not executed can be processed again without counting mails twice.
+// Redis does not roll back a transaction if a single command fails at runtime, e.g. because a key holds a value of another type,
+// so a failed batch may be applied partially if the keys of veloci-meter are modified by someone else.
+type Batch struct {
+	r       *Client
+	counted map[string]bool
+	claimed []string
+	cmds    []func(p redis.Pipeliner)
+}
+
+// NewBatch returns an empty batch for the client.
+func (r *Client) NewBatch() *Batch {
+	return &Batch{r: r, counted: map[string]bool{}}
+}
+
+// Len returns the number of writes collected in the batch.
+func (b *Batch) Len() int {
+	return len(b.cmds)
+}
+
+func (b *Batch) queue(cmd func(p redis.Pipeliner)) {
+	b.cmds = append(b.cmds, cmd)
+}
+
+// Prepare checks with a single round trip which of the mails have already been counted, so Claim does not need to ask redis for each mail.
+func (b *Batch) Prepare(msgs []*imap.Message) error {
+	keys := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		keys = append(keys, messageKey(msg))
+	}
+	cmds, err := b.r.client.Pipelined(func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			p.Exists(b.r.key(key))
+		}
+		return nil
+	})
+	if err = b.r.track(err); err != nil {
+		l.ErrorLog(err, "There was an error while checking {{.count}} mails in redis.", map[string]interface{}{
+			"count": len(msgs)})
+		return err
+	}
+	for i, cmd := range cmds {
+		if cmd.(*redis.IntCmd).Val() == 1 {
+			b.counted[keys[i]] = true
+		}
+	}
+	return nil
+}
+
+// Claim marks a mail as counted for the configured retention and returns true if the mail has not been counted before.
+// Mails are identified by their Message-ID, see messageKey. Mails already counted in redis are only detected if they have been passed to Prepare.
+func (b *Batch) Claim(msg *imap.Message) bool {
+	key := messageKey(msg)
+	if b.counted[key] {
+		return false
+	}
+	b.counted[key] = true
+	b.claimed = append(b.claimed, b.r.key(key))
+	retention := time.Duration(b.r.dedupRetention) * time.Second
+	b.queue(func(p redis.Pipeliner) {
+		p.Set(b.r.key(key), 1, retention)
+	})
+	return true
+}
+
+// StoreMail stores a mail matched by the rule with the given id in redis for duration seconds starting at the timestamp ts of the mail.
+// The key is based on the hash of the rule id, so the count does not depend on the subject or the pattern of the rule.
+// To count multiple mails for the same rule an aditional random int32 is added to the redis key.
+// Mails which are already older than duration are not stored.
+func (b *Batch) StoreMail(id string, msg *imap.Message, duration int, ts time.Time) {
+	keyPattern := mailKeyPattern(id)
+	remaining := time.Duration(duration)*time.Second - time.Since(ts)
+	if remaining < time.Millisecond {
+		l.DebugLog("Mail for rule '{{.rule_id}}' is older than {{.duration}} and is not stored.", map[string]interface{}{
+			"rule_id":         id,
+			"duration":        time.Duration(duration) * time.Second,
+			"message_date":    ts,
+			"message_subject": msg.Envelope.Subject})
+		return
+	}
+	// using a random int32 as part of the redis key
+	randomPart, _ := rand.Int(rand.Reader, big.NewInt(2147483647))
+	redisKey := b.r.key(keyPattern + fmt.Sprint(randomPart))
+	b.queue(func(p redis.Pipeliner) {
+		p.Set(redisKey, 1, remaining)
+	})
+	l.DebugLog("Store {{.redis_key}}{{.random_part}} for {{.duration}}", map[string]interface{}{
+		"redis_key":       keyPattern,
+		"random_part":     randomPart.Text(10),
+		"duration":        remaining,
+		"rule_id":         id,
+		"message_subject": msg.Envelope.Subject})
+}
+
+// StoreMatch adds the metadata of a mail to the list of recent matches of the rule with the given id.
+// The list is capped to the configured number of recent matches, older entries are removed.
+// The list expires duration seconds after the latest match, like the mails counted for the rule.
+func (b *Batch) StoreMatch(id string, m Match, duration int) {
+	redisKey := b.r.key("recent:" + buildHash(id))
+	data, err := json.Marshal(m)
+	if err != nil {
+		l.ErrorLog(err, "Error while marshaling match to JSON", map[string]interface{}{
+			"match": m})
+		return
+	}
+	b.queue(func(p redis.Pipeliner) {
+		p.LPush(redisKey, data)
+		p.LTrim(redisKey, 0, int64(b.r.recentMatches-1))
+		p.Expire(redisKey, time.Duration(duration)*time.Second)
+	})
+	l.DebugLog("Store match for rule '{{.rule_id}}'.", map[string]interface{}{
+		"rule_id": id,
+		"match":   m})
+}
+
+// IncreaseGlobalCounter increments the global counter for the provided timeframe in minutes.
+// If the timeframe for example is 5 (minutes) then the function calculates the redis key for this timeframe based on the timestamp ts of the mail and increments this counter.
+// If there is no redis key it will be 1 after this operation. Mails which are already older than the timeframe are not counted.
+func (b *Batch) IncreaseGlobalCounter(timeframe int, ts time.Time) {
+	if time.Since(ts) >= time.Duration(timeframe)*time.Minute {
+		l.DebugLog("Mail is older than {{.timeframe}} minutes and is not counted.", map[string]interface{}{
+			"timeframe":    timeframe,
+			"message_date": ts,
+		})
+		return
+	}
+	redisKey := b.r.key(calculateGlobalKey(int(ts.Unix()), timeframe, b.r.loc))
+	b.queue(func(p redis.Pipeliner) {
+		p.Incr(redisKey)
+	})
+	l.DebugLog("Increase the global counter for timeframe {{.timeframe}} minutes.", map[string]interface{}{
+		"timeframe": timeframe,
+		"redis_key": redisKey,
+	})
+}
+
+// IncreaseStatisticCountMail increments the mail counter in the daily and the hourly statistics of name.
+func (b *Batch) IncreaseStatisticCountMail(name string) {
+	ts := int(time.Now().Unix())
+	daily := b.r.key(calculateStatsKey("daily", name, ts, b.r.loc))
+	hourly := b.r.key(calculateStatsKey("hourly", name, ts, b.r.loc))
+	b.queue(func(p redis.Pipeliner) {
+		p.HIncrBy(daily, "mail", int64(1))
+		p.HIncrBy(hourly, "mail", int64(1))
+	})
+}
+
+// PublishEvent adds an event for a processed mail received at ts to the configured redis stream.
+// The rule is the name of the rule matching the mail or rules.Unknown. If no stream is configured nothing is published.
+// The stream is capped to about Redis.StreamMaxLen events.
+func (b *Batch) PublishEvent(rule string, msg *imap.Message, ts time.Time) {
+	if b.r.stream == "" {
+		return
+	}
+	from := ""
+	if len(msg.Envelope.From) > 0 {
+		from = msg.Envelope.From[0].Address()
+	}
+	args := &redis.XAddArgs{
+		Stream:       b.r.key(b.r.stream),
+		MaxLenApprox: b.r.streamMaxLen,
+		Values: map[string]interface{}{
+			"timestamp":  ts.Format(time.RFC3339),
+			"rule":       rule,
+			"subject":    msg.Envelope.Subject,
+			"from":       from,
+			"message_id": msg.Envelope.MessageId,
+		},
+	}
+	b.queue(func(p redis.Pipeliner) {
+		p.XAdd(args)
+	})
+}
+
+// Exec sends all writes of the batch to redis in a single transaction.
+// If one of the claimed mails was counted by another process since Prepare, none of the writes are executed and ErrClaimed is returned.
+func (b *Batch) Exec() error {
+	if len(b.cmds) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := b.r.client.Watch(func(tx *redis.Tx) error {
+		if len(b.claimed) > 0 {
+			n, err := tx.Exists(b.claimed...).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrClaimed
+			}
+		}
+		_, err := tx.TxPipelined(func(p redis.Pipeliner) error {
+			for _, cmd := range b.cmds {
+				cmd(p)
+			}
+			return nil
+		})
+		return err
+	}, b.claimed...)
+	duration := time.Since(start)
+	metrics.BatchDuration.Observe(duration.Seconds())
+	if err == ErrClaimed || err == redis.TxFailedErr {
+		l.WarnLog("A batch of {{.count}} writes was not stored, as another process counted the same mails.", map[string]interface{}{
+			"count":    len(b.cmds),
+			"duration": duration})
+		return ErrClaimed
+	}
+	if err = b.r.track(err); err != nil {
+		l.ErrorLog(err, "There was an error while storing a batch of {{.count}} writes in redis.", map[string]interface{}{
+			"count":    len(b.cmds),
+			"duration": duration})
+		return err
+	}
+	l.DebugLog("Stored a batch of {{.count}} writes in redis in {{.duration}}.", map[string]interface{}{
+		"count":    len(b.cmds),
+		"duration": duration})
+	return nil
+}
@@ -0,0 +1,81 @@
+package rdb
+
+import (
+	"encoding/json"
+
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/notify"
+)
+
+// Queue stores check results which could not be sent in a redis hash, so they survive a restart.
+// The hash holds one result per rule, storing a result replaces the queued result of the same rule.
+type Queue struct {
+	r   *Client
+	key string
+}
+
+// Queue returns the retry queue with the given name.
+func (r *Client) Queue(name string) *Queue {
+	return &Queue{r: r, key: "retry:" + name}
+}
+
+// Load returns all queued results.
+func (q *Queue) Load() ([]notify.Result, error) {
+	redisKey := q.r.key(q.key)
+	val, err := q.r.client.HGetAll(redisKey).Result()
+	if err = q.r.track(err); err != nil {
+		l.ErrorLog(err, "There was an error while loading the retry queue from redis.", map[string]interface{}{
+			"redis_key": redisKey})
+		return nil, err
+	}
+	results := make([]notify.Result, 0, len(val))
+	for name, v := range val {
+		var res notify.Result
+		if err := json.Unmarshal([]byte(v), &res); err != nil {
+			l.ErrorLog(err, "There was an error while parsing the queued result of rule '{{.rule}}' from redis. value was {{.redis_result}}", map[string]interface{}{
+				"rule":         name,
+				"redis_result": v})
+			continue
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// Store adds the results to the queue, replacing queued results of the same rules.
+func (q *Queue) Store(results []notify.Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+	redisKey := q.r.key(q.key)
+	fields := make(map[string]interface{}, len(results))
+	for _, res := range results {
+		v, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		fields[res.Name] = string(v)
+	}
+	err := q.r.track(q.r.client.HMSet(redisKey, fields).Err())
+	if err != nil {
+		l.ErrorLog(err, "There was an error while storing {{.count}} results in the retry queue.", map[string]interface{}{
+			"count":     len(results),
+			"redis_key": redisKey})
+	}
+	return err
+}
+
+// Remove deletes the results of the given rules from the queue.
+func (q *Queue) Remove(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	redisKey := q.r.key(q.key)
+	err := q.r.track(q.r.client.HDel(redisKey, names...).Err())
+	if err != nil {
+		l.ErrorLog(err, "There was an error while removing {{.count}} results from the retry queue.", map[string]interface{}{
+			"count":     len(names),
+			"redis_key": redisKey})
+	}
+	return err
+}
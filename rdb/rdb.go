@@ -1,25 +1,62 @@
 package rdb
 
 import (
-	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math"
-	"math/big"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/go-redis/redis"
 	"niecke-it.de/veloci-meter/config"
 	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/metrics"
 )
 
 // Client is the structure wrapping the redis client holding a connection to the server.
 // The redis client can be directly accessed via Client.client
+// The healthy flag reflects the result of the last command sent to the server.
+// All keys written or read by the client are prefixed with the configured key prefix, so several instances can share one database.
 type Client struct {
-	client *redis.Client
+	client         *redis.Client
+	healthy        int32
+	prefix         string
+	recentMatches  int
+	dedupRetention int
+	stream         string
+	streamMaxLen   int64
+	loc            *time.Location
+}
+
+// Match contains the metadata of a mail matched by a rule, so the mails causing an alert can be found in the mailbox.
+type Match struct {
+	MessageID string    `json:"message_id"`
+	Date      time.Time `json:"date"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	UID       uint32    `json:"uid"`
+	Folder    string    `json:"folder"`
+	// Timestamp is the time the mail was counted at, see Mail.TimestampSource.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// NewMatch creates a Match from the envelope and uid of a message fetched from folder.
+func NewMatch(msg *imap.Message, folder string) Match {
+	m := Match{
+		MessageID: msg.Envelope.MessageId,
+		Date:      msg.Envelope.Date,
+		Subject:   msg.Envelope.Subject,
+		UID:       msg.Uid,
+		Folder:    folder,
+	}
+	if len(msg.Envelope.From) > 0 {
+		m.From = msg.Envelope.From[0].Address()
+	}
+	return m
 }
 
 // Stats is the internal structure for storing counts per rule. It contains the name of a rule and counter for for mails matching this rule.
@@ -32,8 +69,58 @@ type Stats struct {
 }
 
 // NewClient uses the redis configuration provided to connect to a redis server and returns a pointer to the Client struct.
-// TODO add reconnect with a wait of n seconds
-func NewClient(c *config.Redis) *Client {
+// The location loc is used to align the days and hours of statistics and the windows of global counters.
+// The connection is not retried. If the server is not reachable the client is returned anyway and marked as unhealthy,
+// the underlying redis client reconnects with the next command.
+func NewClient(c *config.Redis, loc *time.Location) *Client {
+	r := newClient(c, loc)
+	if err := r.Ping(); err != nil {
+		l.ErrorLog(err, "Could not connect to redis. Continuing with an unhealthy connection.", map[string]interface{}{
+			"redis_uri": c.URI,
+		})
+		return r
+	}
+	l.DebugLog("Connection successful.", nil)
+	return r
+}
+
+// Connect works like NewClient, but if the server is not reachable the connection is retried c.ConnectRetries times
+// with an exponential backoff starting at c.RetryBackoff seconds and capped at c.MaxBackoff seconds.
+// It is used when the service starts, so redis may start after veloci-meter.
+func Connect(c *config.Redis, loc *time.Location) *Client {
+	r := newClient(c, loc)
+	backoff := time.Duration(c.RetryBackoff) * time.Second
+	maxBackoff := time.Duration(c.MaxBackoff) * time.Second
+	for attempt := 1; ; attempt++ {
+		// Test the connection via ping
+		err := r.Ping()
+		if err == nil {
+			break
+		}
+		if attempt > c.ConnectRetries {
+			l.ErrorLog(err, "Could not connect to redis after {{.attempts}} attempts. Continuing with an unhealthy connection.", map[string]interface{}{
+				"attempts":  attempt,
+				"redis_uri": c.URI,
+			})
+			return r
+		}
+		l.WarnLog("Connection to redis failed. Retrying in {{.backoff}}.", map[string]interface{}{
+			"attempt":   attempt,
+			"backoff":   backoff,
+			"redis_uri": c.URI,
+			"error":     err,
+		})
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	l.DebugLog("Connection successful.", nil)
+	return r
+}
+
+func newClient(c *config.Redis, loc *time.Location) *Client {
 	l.DebugLog("Connect to redis...", map[string]interface{}{
 		"Addr":       c.URI,
 		"MaxRetries": 3,
@@ -45,15 +132,46 @@ func NewClient(c *config.Redis) *Client {
 			MaxRetries: 3,
 			Password:   c.Password, // no password set
 			DB:         c.Database, // use default DB
-		})}
-	// Test the connection via ping
-	if _, err := r.client.Ping().Result(); err != nil {
-		l.FatalLog(err, "Unknown error", nil)
-	}
-	l.DebugLog("Connection successful.", nil)
+		}),
+		prefix:         c.KeyPrefix,
+		recentMatches:  c.RecentMatches,
+		dedupRetention: c.DedupRetention,
+		stream:         c.Stream,
+		streamMaxLen:   c.StreamMaxLen,
+		loc:            loc}
 	return &r
 }
 
+// Ping sends a ping to the redis server and updates the health of the client.
+func (r *Client) Ping() error {
+	_, err := r.client.Ping().Result()
+	return r.track(err)
+}
+
+// Healthy returns false if the last command sent to redis failed.
+func (r *Client) Healthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// track updates the health of the client based on the error returned by a redis command and returns the error unchanged.
+// redis.Nil is not treated as an error since it only signals a missing key.
+func (r *Client) track(err error) error {
+	if err != nil && err != redis.Nil {
+		metrics.RedisErrors.Inc()
+		if atomic.SwapInt32(&r.healthy, 0) == 1 {
+			l.ErrorLog(err, "Connection to redis lost.", nil)
+		}
+	} else if atomic.SwapInt32(&r.healthy, 1) == 0 {
+		l.InfoLog("Connection to redis is healthy.", nil)
+	}
+	return err
+}
+
+// key adds the configured prefix to a redis key or key pattern.
+func (r *Client) key(k string) string {
+	return r.prefix + k
+}
+
 // Client is only used to acess the internal Redis client from out of the rdb package.
 func (r *Client) Client() *redis.Client {
 	return r.client
@@ -69,79 +187,127 @@ func buildHash(subject string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// StoreMail takes the subject from the imap.Message and calculates the hash to store it in redis.
-// To count multiple mails with the same subject an aditional random int32 is added to the redis key.
-// TODO handel error while r.client.set()
-func (r *Client) StoreMail(msg *imap.Message, duration int) {
-	sha1Hash := buildHash(msg.Envelope.Subject)
-	// using a random int32 as part of the redis key
-	randomPart, _ := rand.Int(rand.Reader, big.NewInt(2147483647))
-	r.client.Set(sha1Hash+":"+fmt.Sprint(randomPart), 1, time.Duration(duration)*time.Second)
-	l.DebugLog("Stored {{.sha1_hash}}:{{.random_part}} for {{.duration}}", map[string]interface{}{
-		"sha1_hash":   sha1Hash,
-		"random_part": randomPart.Text(10),
-		"duration":    time.Duration(duration) * time.Second})
-}
-
-// CountMail calls the redis eval function, to get all keys matching the provided pattern and then count the number of returned keys.
-func (r *Client) CountMail(pattern string) int64 {
-	sha1Hash := buildHash(pattern)
-	v, err := r.client.Eval("return #redis.pcall('keys', '"+sha1Hash+":*')", nil).Result()
-	if err != nil {
-		l.ErrorLog(err, "Error while counting mails in redis.", nil)
-		return int64(0)
+// messageKey returns the redis key marking a mail as counted.
+// The key is based on the Message-ID of the mail. If a mail has no Message-ID a hash of its envelope headers is used instead.
+func messageKey(msg *imap.Message) string {
+	if msg.Envelope.MessageId != "" {
+		return "seen:" + buildHash(msg.Envelope.MessageId)
+	}
+	headers := msg.Envelope.Date.UTC().Format(time.RFC3339) + "\n" + msg.Envelope.Subject
+	for _, addr := range msg.Envelope.From {
+		headers += "\n" + addr.Address()
+	}
+	for _, addr := range msg.Envelope.To {
+		headers += "\n" + addr.Address()
+	}
+	return "seen:" + buildHash(headers)
+}
+
+// mailKeyPattern returns the prefix of all keys storing mails matched by the rule with the given id.
+func mailKeyPattern(id string) string {
+	return "mail:" + buildHash(id) + ":"
+}
+
+// StoreMail stores a mail matched by the rule with the given id in redis for duration seconds starting at the timestamp ts of the mail.
+// See Batch.StoreMail for details.
+func (r *Client) StoreMail(id string, msg *imap.Message, duration int, ts time.Time) error {
+	b := r.NewBatch()
+	b.StoreMail(id, msg, duration, ts)
+	return b.Exec()
+}
+
+// CountMail calls the redis eval function, to get all keys stored for the rule with the given id and then count the number of returned keys.
+// If redis could not be reached the error is returned, so the caller can distinguish between no mails and an unknown count.
+func (r *Client) CountMail(id string) (int64, error) {
+	v, err := r.client.Eval("return #redis.pcall('keys', ARGV[1])", nil, r.key(mailKeyPattern(id)+"*")).Result()
+	if err = r.track(err); err != nil {
+		l.ErrorLog(err, "Error while counting mails in redis.", map[string]interface{}{
+			"rule_id": id})
+		return int64(0), err
 	}
 
-	l.DebugLog("There where {{.mail_count}} mails for pattern '{{.pattern}}' in redis.", map[string]interface{}{
+	l.DebugLog("There where {{.mail_count}} mails for rule '{{.rule_id}}' in redis.", map[string]interface{}{
 		"mail_count": v.(int64),
-		"pattern":    pattern})
-	return v.(int64)
+		"rule_id":    id})
+	return v.(int64), nil
+}
+
+// StoreMatch adds the metadata of a mail to the list of recent matches of the rule with the given id.
+// See Batch.StoreMatch for details.
+func (r *Client) StoreMatch(id string, m Match, duration int) error {
+	b := r.NewBatch()
+	b.StoreMatch(id, m, duration)
+	return b.Exec()
+}
+
+// GetMatches returns up to n recent matches of the rule with the given id, the latest match first.
+func (r *Client) GetMatches(id string, n int) ([]Match, error) {
+	redisKey := r.key("recent:" + buildHash(id))
+	val, err := r.client.LRange(redisKey, 0, int64(n-1)).Result()
+	if err = r.track(err); err != nil {
+		l.ErrorLog(err, "There was an error while getting matches for rule '{{.rule_id}}' from redis.", map[string]interface{}{
+			"rule_id":   id,
+			"redis_key": redisKey})
+		return nil, err
+	}
+	matches := make([]Match, 0, len(val))
+	for _, v := range val {
+		var m Match
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			l.ErrorLog(err, "There was an error while parsing a match for rule '{{.rule_id}}' from redis. value was {{.redis_result}}", map[string]interface{}{
+				"rule_id":      id,
+				"redis_result": v})
+			continue
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
 }
 
-func calculateGlobalKey(timestamp int, timeframe int) string {
-	remainder := math.Mod(float64(timestamp), float64(timeframe*60))
-	keyPart := timestamp - int(remainder)
+// windowStart returns the start of the window of length d containing the timestamp.
+// Windows are aligned to midnight in loc. Since they are calculated from the time elapsed since midnight they stay aligned on days with a DST change.
+func windowStart(timestamp int, d time.Duration, loc *time.Location) int {
+	t := time.Unix(int64(timestamp), 0).In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	if d >= 24*time.Hour {
+		return int(midnight.Unix())
+	}
+	return int(midnight.Add(t.Sub(midnight).Truncate(d)).Unix())
+}
+
+func calculateGlobalKey(timestamp int, timeframe int, loc *time.Location) string {
+	keyPart := windowStart(timestamp, time.Duration(timeframe)*time.Minute, loc)
 	return "global:" + fmt.Sprint(timeframe) + ":" + fmt.Sprint(keyPart)
 }
 
 // IncreaseGlobalCounter increments the global counter for the provided timeframe in minutes.
-// If the timeframe for example is 5 (minutes) then the function calculates the redis key for this timeframe based on the actual time and increments this counter.
-// If there is no redis key it will be 1 after this operation.
-func (r *Client) IncreaseGlobalCounter(timeframe int) {
-	timestamp := int(time.Now().Unix())
-	redisKey := calculateGlobalKey(timestamp, timeframe)
-	val, err := r.client.Incr(redisKey).Result()
-	if err != nil {
-		l.ErrorLog(err, "Redis Command executed: [INCR {{.redis_key}}]", map[string]interface{}{
-			"redis_key": redisKey,
-		})
-	} else {
-		l.DebugLog("The global counter for timeframe {{.timeframe}} minutes was increased.", map[string]interface{}{
-			"timeframe":    timeframe,
-			"redis_result": val,
-		})
-	}
+// See Batch.IncreaseGlobalCounter for details.
+func (r *Client) IncreaseGlobalCounter(timeframe int, ts time.Time) error {
+	b := r.NewBatch()
+	b.IncreaseGlobalCounter(timeframe, ts)
+	return b.Exec()
 }
 
 // GetGlobalCounter returns the number of mails for the actual timeframe of n minutes.
 // If there has been no data in redis this function returns 0 since there have been no mails processed for this timestamp.
-func (r *Client) GetGlobalCounter(timeframe int) int {
+// If redis could not be reached or the stored value is not a number an error is returned.
+func (r *Client) GetGlobalCounter(timeframe int) (int, error) {
 	timestamp := int(time.Now().Unix())
-	redisKey := calculateGlobalKey(timestamp, timeframe)
+	redisKey := r.key(calculateGlobalKey(timestamp, timeframe, r.loc))
 	val, err := r.client.Get(redisKey).Result()
 
-	if err != nil {
+	if err = r.track(err); err != nil {
 		if err == redis.Nil {
 			// If err == redis.Nil there has been no redis key for the actual timeframe thus no mails have been processed
 			l.DebugLog("There has been no data for timefram {{.timeframe}} minutes thus 0 was returned.", map[string]interface{}{
 				"timeframe":    timeframe,
 				"redis_result": 0})
-			return 0
+			return 0, nil
 		}
 		l.ErrorLog(err, "There was an error while getting global counter from redis.", map[string]interface{}{
 			"redis_key": redisKey,
 		})
-		return 0
+		return 0, err
 	}
 
 	// Parse the result from redis into int
@@ -149,24 +315,26 @@ func (r *Client) GetGlobalCounter(timeframe int) int {
 	if err != nil {
 		l.ErrorLog(err, "There was an error while parsing global counter value from redis. value was {{.redis_result}}", map[string]interface{}{
 			"redis_result": val})
+		return 0, err
 	}
 
 	l.DebugLog("There have been {{.redis_result}} mails for timeframe '{{.timeframe}}' minutes.", map[string]interface{}{
 		"timeframe":    timeframe,
 		"redis_result": c,
 	})
-	return c
+	return c, nil
 }
 
 // GetKeys calls the redis keys command with the specified pattern and returns list of matching keys.
-func (r *Client) GetKeys(pattern string) []string {
-	val, err := r.client.Keys(pattern).Result()
+// The pattern and the returned keys are relative to the configured key prefix.
+func (r *Client) GetKeys(pattern string) ([]string, error) {
+	val, err := r.client.Keys(r.key(pattern)).Result()
 
-	if err != nil {
+	if err = r.track(err); err != nil {
 		l.ErrorLog(err, "There was an error while getting keys from redis. Key pattern was {{.pattern}}", map[string]interface{}{
 			"pattern": pattern,
 		})
-		return []string{}
+		return []string{}, err
 	}
 
 	l.DebugLog("There has been {{.count}} keys for pattern '{{.pattern}}'", map[string]interface{}{
@@ -174,16 +342,18 @@ func (r *Client) GetKeys(pattern string) []string {
 		"redis_result": val,
 		"count":        len(val),
 	})
-	return val
-
+	for i, key := range val {
+		val[i] = strings.TrimPrefix(key, r.prefix)
+	}
+	return val, nil
 }
 
 // DeleteKey calls the redis del function and returns the result.
-// If there was an error zero is returned.
+// The key is relative to the configured key prefix. If there was an error zero is returned.
 func (r *Client) DeleteKey(key string) int64 {
-	val, err := r.client.Del(key).Result()
+	val, err := r.client.Del(r.key(key)).Result()
 
-	if err != nil {
+	if err = r.track(err); err != nil {
 		l.ErrorLog(err, "There was an error while deleting {{.redis_key}} from redis.", map[string]interface{}{
 			"redis_key": key,
 		})
@@ -197,12 +367,34 @@ func (r *Client) DeleteKey(key string) int64 {
 	return val
 }
 
+// StatsPatterns matches the redis prefixes to the granularity of the statistics stored with this prefix.
+// The prefixes are relative to Redis.KeyPrefix and are followed by the name and the timestamp of the bucket.
+var StatsPatterns = map[string]string{
+	"daily":  "stats:",
+	"hourly": "stats-hourly:",
+}
+
+func calculateStatsKey(granularity string, name string, timestamp int, loc *time.Location) string {
+	var bucket int
+	if granularity == "hourly" {
+		bucket = windowStart(timestamp, time.Hour, loc)
+	} else {
+		bucket = windowStart(timestamp, 24*time.Hour, loc)
+	}
+	return StatsPatterns[granularity] + name + ":" + fmt.Sprint(bucket)
+}
+
+// increaseStatisticCount increments the counter of type t in the daily and the hourly statistics of name and returns the daily count.
 func (r *Client) increaseStatisticCount(name string, t string) int64 {
 	ts := int(time.Now().Unix())
-	timestampDay := ts - int(math.Mod(float64(ts), float64(24*60*60)))
-	val, err := r.client.HIncrBy("stats:"+name+":"+fmt.Sprint(timestampDay), t, int64(1)).Result()
+	var daily *redis.IntCmd
+	_, err := r.client.Pipelined(func(p redis.Pipeliner) error {
+		daily = p.HIncrBy(r.key(calculateStatsKey("daily", name, ts, r.loc)), t, int64(1))
+		p.HIncrBy(r.key(calculateStatsKey("hourly", name, ts, r.loc)), t, int64(1))
+		return nil
+	})
 
-	if err != nil {
+	if err = r.track(err); err != nil {
 		l.ErrorLog(err, "There was an error while increasing stats [{{.stat_type}}] for name '{{.redis_key}}'.", map[string]interface{}{
 			"redis_key": name,
 			"stat_type": t,
@@ -210,6 +402,7 @@ func (r *Client) increaseStatisticCount(name string, t string) int64 {
 		return int64(0)
 	}
 
+	val := daily.Val()
 	l.DebugLog("Stats counter [{{.stat_type}}] for key '{{.redis_key}}' is now at {{.redis_val}}", map[string]interface{}{
 		"redis_key":    name,
 		"redis_result": val,
@@ -236,13 +429,21 @@ func (r *Client) IncreaseStatisticCountCritical(name string) int64 {
 	return r.increaseStatisticCount(name, "critical")
 }
 
-// GetStatisticCount returns the actual number of hits for one name.
+// GetStatisticCount returns the actual number of hits for one name on the day of timestamp.
 func (r *Client) GetStatisticCount(name string, timestamp int) Stats {
+	return r.getStatisticCount("daily", name, timestamp)
+}
+
+// GetHourlyStatisticCount returns the actual number of hits for one name in the hour of timestamp.
+func (r *Client) GetHourlyStatisticCount(name string, timestamp int) Stats {
+	return r.getStatisticCount("hourly", name, timestamp)
+}
+
+func (r *Client) getStatisticCount(granularity string, name string, timestamp int) Stats {
 	stats := Stats{Name: name, Mail: 0, Warning: 0, Critical: 0}
-	timestampDay := timestamp - int(math.Mod(float64(timestamp), float64(24*60*60)))
-	val, err := r.client.HMGet("stats:"+name+":"+fmt.Sprint(timestampDay), "mail", "warning", "critical").Result()
+	val, err := r.client.HMGet(r.key(calculateStatsKey(granularity, name, timestamp, r.loc)), "mail", "warning", "critical").Result()
 
-	if err != nil {
+	if err = r.track(err); err != nil {
 		l.ErrorLog(err, "There was an error while getting stats for name '{{.redis_key}}'.", map[string]interface{}{
 			"redis_key": name,
 			"stats":     stats,
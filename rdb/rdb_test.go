@@ -8,75 +8,414 @@ import (
 
 	"github.com/emersion/go-imap"
 	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
 	"niecke-it.de/veloci-meter/test"
 )
 
 func TestStoreMail(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
 	msg := imap.Message{}
 	envelope := imap.Envelope{Subject: "Test", MessageId: "test"}
 	msg.Envelope = &envelope
 
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-	r.StoreMail(&msg, 15)
-
-	result := r.CountMail("Test")
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+	r.StoreMail("Test rule", &msg, 15, time.Now())
+
+	result, err := r.CountMail("Test rule")
 	expected := int64(10)
 	test.CheckResult(t, result, expected)
+	test.CheckResult(t, err, nil)
 
 	r.client.FlushDB()
 }
 
+func TestStoreMailTimestamp(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	msg := imap.Message{}
+	envelope := imap.Envelope{Subject: "Test", MessageId: "test"}
+	msg.Envelope = &envelope
+
+	r.StoreMail("Test rule", &msg, 15, time.Now().Add(-10*time.Second))
+	r.StoreMail("Test rule", &msg, 15, time.Now().Add(-20*time.Second))
+
+	result, _ := r.CountMail("Test rule")
+	test.CheckResult(t, result, int64(1))
+
+	keys, _ := r.GetKeys(mailKeyPattern("Test rule") + "*")
+	ttl := r.client.PTTL(keys[0]).Val()
+	test.CheckResult(t, ttl > 0 && ttl <= 5*time.Second, true)
+
+	r.client.FlushDB()
+}
+
+func TestGlobalCounterTimestamp(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	// a mail older than the timeframe is dropped
+	r.IncreaseGlobalCounter(5, time.Now().Add(-10*time.Minute))
+	keys, _ := r.GetKeys("global:*")
+	test.CheckResult(t, len(keys), 0)
+
+	// a mail is counted in the window it was received
+	ts := time.Now().Add(-4 * time.Minute)
+	r.IncreaseGlobalCounter(5, ts)
+	keys, _ = r.GetKeys("global:*")
+	test.CheckResult(t, len(keys), 1)
+	test.CheckResult(t, keys[0], calculateGlobalKey(int(ts.Unix()), 5, config.Location))
+
+	r.client.FlushDB()
+}
+
+func TestStoreMailPerRule(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	msg := imap.Message{}
+	envelope := imap.Envelope{Subject: "Some mail subject", MessageId: "test"}
+	msg.Envelope = &envelope
+
+	r.StoreMail("first rule", &msg, 15, time.Now())
+	r.StoreMail("first rule", &msg, 15, time.Now())
+	r.StoreMail("second rule", &msg, 15, time.Now())
+
+	result, _ := r.CountMail("first rule")
+	test.CheckResult(t, result, int64(2))
+
+	result, _ = r.CountMail("second rule")
+	test.CheckResult(t, result, int64(1))
+
+	result, _ = r.CountMail("Some mail subject")
+	test.CheckResult(t, result, int64(0))
+
+	r.client.FlushDB()
+}
+
+func TestStoreMatch(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	config.Redis.RecentMatches = 3
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	for i := 0; i < 5; i++ {
+		msg := imap.Message{Uid: uint32(i)}
+		envelope := imap.Envelope{
+			Subject:   fmt.Sprintf("Mail %d", i),
+			MessageId: fmt.Sprintf("<%d@local>", i),
+			From:      []*imap.Address{{MailboxName: "sender", HostName: "local"}},
+		}
+		msg.Envelope = &envelope
+		r.StoreMatch("Test rule", NewMatch(&msg, "INBOX"), 15)
+	}
+
+	matches, err := r.GetMatches("Test rule", 10)
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, len(matches), 3)
+	test.CheckResult(t, matches[0].Subject, "Mail 4")
+	test.CheckResult(t, matches[0].MessageID, "<4@local>")
+	test.CheckResult(t, matches[0].From, "sender@local")
+	test.CheckResult(t, matches[0].UID, uint32(4))
+	test.CheckResult(t, matches[0].Folder, "INBOX")
+	test.CheckResult(t, matches[2].Subject, "Mail 2")
+
+	matches, _ = r.GetMatches("Test rule", 1)
+	test.CheckResult(t, len(matches), 1)
+
+	matches, _ = r.GetMatches("Other rule", 1)
+	test.CheckResult(t, len(matches), 0)
+
+	// the matches expire with the timeframe of the rule
+	ttl, _ := r.client.TTL("recent:" + buildHash("Test rule")).Result()
+	test.CheckResult(t, ttl, 15*time.Second)
+
+	r.client.FlushDB()
+}
+
+func TestBatchClaim(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	first := imap.Message{Envelope: &imap.Envelope{Subject: "Test", MessageId: "<1@local>"}}
+	second := imap.Message{Envelope: &imap.Envelope{Subject: "Test", MessageId: "<2@local>"}}
+	msgs := []*imap.Message{&first, &second}
+
+	b := r.NewBatch()
+	test.CheckResult(t, b.Prepare(msgs), nil)
+	test.CheckResult(t, b.Claim(&first), true)
+	test.CheckResult(t, b.Claim(&first), false)
+	test.CheckResult(t, b.Exec(), nil)
+
+	// the first mail has been counted by the previous batch
+	b = r.NewBatch()
+	b.Prepare(msgs)
+	test.CheckResult(t, b.Claim(&first), false)
+	test.CheckResult(t, b.Claim(&second), true)
+
+	r.client.FlushDB()
+}
+
+func TestBatchClaimConcurrent(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	msg := imap.Message{Envelope: &imap.Envelope{Subject: "Test", MessageId: "<1@local>"}}
+	msgs := []*imap.Message{&msg}
+
+	// both batches see the mail as not counted yet, only the first one is stored
+	first := r.NewBatch()
+	second := r.NewBatch()
+	first.Prepare(msgs)
+	second.Prepare(msgs)
+	test.CheckResult(t, first.Claim(&msg), true)
+	test.CheckResult(t, second.Claim(&msg), true)
+	first.StoreMail("Test rule", &msg, 15, time.Now())
+	second.StoreMail("Test rule", &msg, 15, time.Now())
+	test.CheckResult(t, first.Exec(), nil)
+	test.CheckResult(t, second.Exec(), ErrClaimed)
+
+	count, _ := r.CountMail("Test rule")
+	test.CheckResult(t, count, int64(1))
+
+	r.client.FlushDB()
+}
+
+func TestBatchClaimWithoutMessageID(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	date := time.Date(2020, 11, 22, 12, 0, 0, 0, time.UTC)
+	from := []*imap.Address{{MailboxName: "sender", HostName: "local"}}
+	first := imap.Message{Envelope: &imap.Envelope{Subject: "Test", Date: date, From: from}}
+	duplicate := imap.Message{Envelope: &imap.Envelope{Subject: "Test", Date: date, From: from}}
+	later := imap.Message{Envelope: &imap.Envelope{Subject: "Test", Date: date.Add(time.Minute), From: from}}
+
+	b := r.NewBatch()
+	b.Prepare([]*imap.Message{&first, &duplicate, &later})
+	test.CheckResult(t, b.Claim(&first), true)
+	test.CheckResult(t, b.Claim(&duplicate), false)
+	test.CheckResult(t, b.Claim(&later), true)
+
+	r.client.FlushDB()
+}
+
+func TestBatchExec(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	msg := imap.Message{Envelope: &imap.Envelope{Subject: "Test", MessageId: "<1@local>"}}
+	b := r.NewBatch()
+	b.Claim(&msg)
+	b.StoreMail("Test rule", &msg, 15, time.Now())
+	b.StoreMatch("Test rule", NewMatch(&msg, "INBOX"), 15)
+	b.IncreaseStatisticCountMail("Test rule")
+	b.IncreaseGlobalCounter(5, time.Now())
+	test.CheckResult(t, b.Len(), 5)
+
+	// nothing is written before Exec
+	count, _ := r.CountMail("Test rule")
+	test.CheckResult(t, count, int64(0))
+
+	test.CheckResult(t, b.Exec(), nil)
+	count, _ = r.CountMail("Test rule")
+	test.CheckResult(t, count, int64(1))
+	matches, _ := r.GetMatches("Test rule", 1)
+	test.CheckResult(t, len(matches), 1)
+	test.CheckResult(t, r.GetStatisticCount("Test rule", int(time.Now().Unix())).Mail, int64(1))
+	c, _ := r.GetGlobalCounter(5)
+	test.CheckResult(t, c, 1)
+
+	r.client.FlushDB()
+}
+
+func TestBatchPublishEvent(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	config.Redis.KeyPrefix = "test:"
+	config.Redis.Stream = "events"
+	config.Redis.StreamMaxLen = 100
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	ts := time.Date(2020, 11, 22, 12, 0, 0, 0, time.UTC)
+	msg := imap.Message{Envelope: &imap.Envelope{
+		Subject:   "Test",
+		MessageId: "<1@local>",
+		From:      []*imap.Address{{MailboxName: "sender", HostName: "local"}},
+	}}
+	b := r.NewBatch()
+	b.PublishEvent("Test rule", &msg, ts)
+	b.PublishEvent("unknown", &msg, ts)
+	test.CheckResult(t, b.Exec(), nil)
+
+	events := r.client.XRange("test:events", "-", "+").Val()
+	test.CheckResult(t, len(events), 2)
+	test.CheckResult(t, events[0].Values["rule"], "Test rule")
+	test.CheckResult(t, events[0].Values["subject"], "Test")
+	test.CheckResult(t, events[0].Values["from"], "sender@local")
+	test.CheckResult(t, events[0].Values["message_id"], "<1@local>")
+	test.CheckResult(t, events[0].Values["timestamp"], "2020-11-22T12:00:00Z")
+	test.CheckResult(t, events[1].Values["rule"], "unknown")
+
+	// without a stream nothing is published
+	config.Redis.Stream = ""
+	r = NewClient(&config.Redis, config.Location)
+	b = r.NewBatch()
+	b.PublishEvent("Test rule", &msg, ts)
+	test.CheckResult(t, b.Len(), 0)
+
+	r.client.FlushDB()
+}
+
+func TestBatchExecError(t *testing.T) {
+	r := NewClient(&config.Redis{URI: "localhost:1"}, time.UTC)
+	msg := imap.Message{Envelope: &imap.Envelope{Subject: "Test", MessageId: "<1@local>"}}
+
+	b := r.NewBatch()
+	test.CheckResult(t, b.Prepare([]*imap.Message{&msg}) != nil, true)
+	b.StoreMail("Test rule", &msg, 15, time.Now())
+	test.CheckResult(t, b.Exec() != nil, true)
+}
+
+func TestUnhealthyClient(t *testing.T) {
+	r := Connect(&config.Redis{URI: "localhost:1", ConnectRetries: 1}, time.UTC)
+	test.CheckResult(t, r.Healthy(), false)
+
+	_, err := r.CountMail("Test rule")
+	test.CheckResult(t, err != nil, true)
+
+	_, err = r.GetGlobalCounter(5)
+	test.CheckResult(t, err != nil, true)
+
+	err = r.IncreaseGlobalCounter(5, time.Now())
+	test.CheckResult(t, err != nil, true)
+	test.CheckResult(t, r.Healthy(), false)
+}
+
+func TestHealthyClient(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	test.CheckResult(t, r.Healthy(), true)
+}
+
+func TestKeyPrefix(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	prod := NewClient(&config.Redis, config.Location)
+	prod.client.FlushDB()
+	config.Redis.KeyPrefix = "staging:"
+	staging := NewClient(&config.Redis, config.Location)
+
+	msg := imap.Message{}
+	envelope := imap.Envelope{Subject: "Test", MessageId: "test"}
+	msg.Envelope = &envelope
+
+	prod.StoreMail("Test rule", &msg, 15, time.Now())
+	staging.StoreMail("Test rule", &msg, 15, time.Now())
+	staging.StoreMail("Test rule", &msg, 15, time.Now())
+	staging.IncreaseGlobalCounter(5, time.Now())
+
+	result, _ := prod.CountMail("Test rule")
+	test.CheckResult(t, result, int64(1))
+	result, _ = staging.CountMail("Test rule")
+	test.CheckResult(t, result, int64(2))
+
+	c, _ := prod.GetGlobalCounter(5)
+	test.CheckResult(t, c, 0)
+	c, _ = staging.GetGlobalCounter(5)
+	test.CheckResult(t, c, 1)
+
+	keys, _ := staging.GetKeys("global:*")
+	test.CheckResult(t, len(keys), 1)
+	test.CheckResult(t, keys[0], calculateGlobalKey(int(time.Now().Unix()), 5, config.Location))
+	test.CheckResult(t, staging.DeleteKey(keys[0]), int64(1))
+
+	prod.client.FlushDB()
+}
+
 func TestCalculateGlobalKey1(t *testing.T) {
-	result := calculateGlobalKey(1606044626, 5)
+	result := calculateGlobalKey(1606044626, 5, time.UTC)
 	expected := "global:5:1606044600"
 	test.CheckResult(t, result, expected)
 }
 
 func TestCalculateGlobalKey2(t *testing.T) {
-	result := calculateGlobalKey(1606044600, 5)
+	result := calculateGlobalKey(1606044600, 5, time.UTC)
 	expected := "global:5:1606044600"
 	test.CheckResult(t, result, expected)
 }
 func TestCalculateGlobalKey3(t *testing.T) {
-	result := calculateGlobalKey(1606044626, 60)
+	result := calculateGlobalKey(1606044626, 60, time.UTC)
 	expected := "global:60:1606042800"
 	test.CheckResult(t, result, expected)
 }
 
 func TestCalculateGlobalKey4(t *testing.T) {
-	result := calculateGlobalKey(1606042800, 60)
+	result := calculateGlobalKey(1606042800, 60, time.UTC)
 	expected := "global:60:1606042800"
 	test.CheckResult(t, result, expected)
 }
 
+func TestCalculateGlobalKeyTimezone(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Kolkata")
+	// 2020-11-22 17:00:26 in Kolkata (UTC+05:30)
+	result := calculateGlobalKey(1606044626, 60, loc)
+	expected := "global:60:1606044600"
+	test.CheckResult(t, result, expected)
+}
+
+func TestWindowStartDST(t *testing.T) {
+	loc, _ := time.LoadLocation("Europe/Berlin")
+	// 2020-10-25 is 25 hours long in Berlin, the hour from 02:00 to 03:00 exists twice
+	midnight := time.Date(2020, 10, 25, 0, 0, 0, 0, loc)
+	secondTwoOClock := midnight.Add(3 * time.Hour)
+	test.CheckResult(t, secondTwoOClock.Hour(), 2)
+
+	test.CheckResult(t, windowStart(int(midnight.Add(23*time.Hour).Unix()), 24*time.Hour, loc), int(midnight.Unix()))
+	test.CheckResult(t, windowStart(int(secondTwoOClock.Add(30*time.Minute).Unix()), time.Hour, loc), int(secondTwoOClock.Unix()))
+	test.CheckResult(t, windowStart(int(midnight.Add(25*time.Hour).Unix()), 24*time.Hour, loc), int(midnight.Add(25*time.Hour).Unix()))
+
+	// 2020-03-29 is 23 hours long in Berlin, 03:00 follows 01:59
+	midnight = time.Date(2020, 3, 29, 0, 0, 0, 0, loc)
+	threeOClock := midnight.Add(2 * time.Hour)
+	test.CheckResult(t, threeOClock.Hour(), 3)
+	test.CheckResult(t, windowStart(int(threeOClock.Add(30*time.Minute).Unix()), time.Hour, loc), int(threeOClock.Unix()))
+	test.CheckResult(t, windowStart(int(threeOClock.Add(7*time.Minute).Unix()), 5*time.Minute, loc), int(threeOClock.Add(5*time.Minute).Unix()))
+}
+
 func TestGlobalCounter5m(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
-	result := r.GetGlobalCounter(5)
+	result, _ := r.GetGlobalCounter(5)
 	expected := 0
 	test.CheckResult(t, result, expected)
 
-	r.IncreaseGlobalCounter(5)
-	r.IncreaseGlobalCounter(5)
-	r.IncreaseGlobalCounter(5)
-	r.IncreaseGlobalCounter(5)
-	r.IncreaseGlobalCounter(5)
+	r.IncreaseGlobalCounter(5, time.Now())
+	r.IncreaseGlobalCounter(5, time.Now())
+	r.IncreaseGlobalCounter(5, time.Now())
+	r.IncreaseGlobalCounter(5, time.Now())
+	r.IncreaseGlobalCounter(5, time.Now())
 
-	result = r.GetGlobalCounter(5)
+	result, _ = r.GetGlobalCounter(5)
 	expected = 5
 	test.CheckResult(t, result, expected)
 
@@ -85,49 +424,53 @@ func TestGlobalCounter5m(t *testing.T) {
 
 func TestGetGlobalCounterParseError(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
 	timeframe := 5
 	timestamp := int(time.Now().Unix())
-	redisKey := calculateGlobalKey(timestamp, timeframe)
+	redisKey := calculateGlobalKey(timestamp, timeframe, config.Location)
 	_, err := r.client.Set(redisKey, "t", time.Duration(0)).Result()
 
 	if err != nil {
 		t.Errorf("TestGetGlobalCounterParseError() test returned an unexpected result: [%v]", err)
 	}
 
-	result := r.GetGlobalCounter(5)
+	result, err := r.GetGlobalCounter(5)
 	expected := 0
 	test.CheckResult(t, result, expected)
+	test.CheckResult(t, err != nil, true)
 
 	r.client.FlushDB()
 }
 
 func TestGlobalCounter5mEmpty(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
-	result := r.GetGlobalCounter(5)
+	result, err := r.GetGlobalCounter(5)
 	expected := 0
 	test.CheckResult(t, result, expected)
+	test.CheckResult(t, err, nil)
 
 	r.client.FlushDB()
 }
 
 func TestGetKeys(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
-	result := len(r.GetKeys("global:*"))
+	keys, _ := r.GetKeys("global:*")
+	result := len(keys)
 	expected := 0
 	test.CheckResult(t, result, expected)
 
-	r.IncreaseGlobalCounter(5)
+	r.IncreaseGlobalCounter(5, time.Now())
 
-	result = len(r.GetKeys("global:*"))
+	keys, _ = r.GetKeys("global:*")
+	result = len(keys)
 	expected = 1
 	test.CheckResult(t, result, expected)
 
@@ -136,7 +479,7 @@ func TestGetKeys(t *testing.T) {
 
 func TestDeleteKey(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
 	_, err := r.client.Set("Test-Key", 1, time.Duration(60)*time.Second).Result()
@@ -154,7 +497,7 @@ func TestDeleteKey(t *testing.T) {
 
 func TestDeleteKeyMissing(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
 	result := r.DeleteKey("Test-Key")
@@ -167,7 +510,7 @@ func TestDeleteKeyMissing(t *testing.T) {
 func TestStatisticCountMail(t *testing.T) {
 	ts := int(time.Now().Unix())
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
 	result := r.GetStatisticCount("TEST-Rule-Name", ts).Mail
@@ -208,7 +551,7 @@ func TestStatisticCountMail(t *testing.T) {
 func TestStatisticCountWarning(t *testing.T) {
 	ts := int(time.Now().Unix())
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
 	result := r.GetStatisticCount("TEST-Rule-Name", ts).Mail
@@ -249,7 +592,7 @@ func TestStatisticCountWarning(t *testing.T) {
 func TestStatisticCountCritical(t *testing.T) {
 	ts := int(time.Now().Unix())
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 
 	result := r.GetStatisticCount("TEST-Rule-Name", ts).Mail
@@ -287,11 +630,37 @@ func TestStatisticCountCritical(t *testing.T) {
 	r.client.FlushDB()
 }
 
+func TestHourlyStatisticCount(t *testing.T) {
+	ts := int(time.Now().Unix())
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	r.IncreaseStatisticCountMail("TEST-Rule-Name")
+	r.IncreaseStatisticCountMail("TEST-Rule-Name")
+	r.IncreaseStatisticCountCritical("TEST-Rule-Name")
+
+	stats := r.GetHourlyStatisticCount("TEST-Rule-Name", ts)
+	test.CheckResult(t, stats.Mail, int64(2))
+	test.CheckResult(t, stats.Warning, int64(0))
+	test.CheckResult(t, stats.Critical, int64(1))
+
+	stats = r.GetHourlyStatisticCount("TEST-Rule-Name", ts-3600)
+	test.CheckResult(t, stats.Mail, int64(0))
+
+	r.client.FlushDB()
+}
+
+func TestCalculateStatsKey(t *testing.T) {
+	test.CheckResult(t, calculateStatsKey("daily", "rule", 1606044626, time.UTC), "stats:rule:1606003200")
+	test.CheckResult(t, calculateStatsKey("hourly", "rule", 1606044626, time.UTC), "stats-hourly:rule:1606042800")
+}
+
 func TestStatisticCountParseError(t *testing.T) {
 	ts := int(time.Now().Unix())
 	timestampDay := ts - int(math.Mod(float64(ts), float64(24*60*60)))
 	config := config.LoadConfig("../config/config.example.json")
-	r := NewClient(&config.Redis)
+	r := NewClient(&config.Redis, config.Location)
 	r.client.FlushDB()
 	r.client.HSet("stats:TestHash:"+fmt.Sprint(timestampDay), "mail", "t")
 	r.client.HSet("stats:TestHash:"+fmt.Sprint(timestampDay), "warning", "t")
@@ -311,3 +680,33 @@ func TestStatisticCountParseError(t *testing.T) {
 
 	r.client.FlushDB()
 }
+
+func TestQueue(t *testing.T) {
+	config := config.LoadConfig("../config/config.example.json")
+	r := NewClient(&config.Redis, config.Location)
+	r.client.FlushDB()
+
+	q := r.Queue("icinga")
+	err := q.Store([]notify.Result{{Name: "first", State: notify.CRITICAL, Count: 4}, {Name: "second"}})
+	test.CheckResult(t, err, nil)
+	// a queued result is replaced by the latest result of the rule
+	err = q.Store([]notify.Result{{Name: "first", State: notify.OK, Count: 1}})
+	test.CheckResult(t, err, nil)
+
+	results, err := q.Load()
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, len(results), 2)
+	for _, res := range results {
+		if res.Name == "first" {
+			test.CheckResult(t, res.State, notify.OK)
+			test.CheckResult(t, res.Count, int64(1))
+		}
+	}
+
+	err = q.Remove([]string{"first", "second"})
+	test.CheckResult(t, err, nil)
+	results, _ = q.Load()
+	test.CheckResult(t, len(results), 0)
+
+	r.client.FlushDB()
+}
@@ -0,0 +1,191 @@
+package rdb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+	l "niecke-it.de/veloci-meter/logging"
+)
+
+// Entry is the portable representation of one redis key used to export and restore the state of veloci-meter.
+// The key is relative to Redis.KeyPrefix. TTL is the remaining time to live in milliseconds or -1 if the key does not expire.
+// Depending on Type the value is a string, a map of strings (hash), a list of strings (list) or a list of stream messages (stream).
+type Entry struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	TTL   int64       `json:"ttl"`
+	Value interface{} `json:"value"`
+}
+
+// StreamMessage is one message of a redis stream.
+type StreamMessage struct {
+	ID     string                 `json:"id"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// statePatterns returns the patterns of all keys written by veloci-meter.
+func (r *Client) statePatterns() []string {
+	patterns := []string{"mail:*", "global:*", "recent:*", "seen:*", "retry:*"}
+	for _, val := range StatsPatterns {
+		patterns = append(patterns, val+"*")
+	}
+	if r.stream != "" {
+		patterns = append(patterns, r.stream)
+	}
+	return patterns
+}
+
+// Dump returns all keys written by veloci-meter with their type, remaining time to live and value.
+func (r *Client) Dump() ([]Entry, error) {
+	keys := []string{}
+	for _, pattern := range r.statePatterns() {
+		k, err := r.GetKeys(pattern)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
+
+	// get type and ttl of all keys
+	cmds, err := r.client.Pipelined(func(p redis.Pipeliner) error {
+		for _, key := range keys {
+			p.Type(r.key(key))
+			p.PTTL(r.key(key))
+		}
+		return nil
+	})
+	if err = r.track(err); err != nil {
+		l.ErrorLog(err, "There was an error while reading {{.count}} keys from redis.", map[string]interface{}{
+			"count": len(keys)})
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(keys))
+	for i, key := range keys {
+		ttl := cmds[2*i+1].(*redis.DurationCmd).Val()
+		entry := Entry{Key: key, Type: cmds[2*i].(*redis.StatusCmd).Val(), TTL: -1}
+		if ttl > 0 {
+			entry.TTL = int64(ttl / time.Millisecond)
+		}
+		entries = append(entries, entry)
+	}
+
+	// get the values of all keys
+	cmds, err = r.client.Pipelined(func(p redis.Pipeliner) error {
+		for _, entry := range entries {
+			switch entry.Type {
+			case "string":
+				p.Get(r.key(entry.Key))
+			case "hash":
+				p.HGetAll(r.key(entry.Key))
+			case "list":
+				p.LRange(r.key(entry.Key), 0, -1)
+			case "stream":
+				p.XRange(r.key(entry.Key), "-", "+")
+			default:
+				// the key expired in the meantime or has an unsupported type
+				p.Exists(r.key(entry.Key))
+			}
+		}
+		return nil
+	})
+	if err = r.track(err); err != nil && err != redis.Nil {
+		l.ErrorLog(err, "There was an error while reading {{.count}} values from redis.", map[string]interface{}{
+			"count": len(entries)})
+		return nil, err
+	}
+	result := make([]Entry, 0, len(entries))
+	for i, entry := range entries {
+		switch cmd := cmds[i].(type) {
+		case *redis.StringCmd:
+			if cmd.Err() == redis.Nil {
+				continue
+			}
+			entry.Value = cmd.Val()
+		case *redis.StringStringMapCmd:
+			entry.Value = cmd.Val()
+		case *redis.StringSliceCmd:
+			entry.Value = cmd.Val()
+		case *redis.XMessageSliceCmd:
+			messages := []StreamMessage{}
+			for _, m := range cmd.Val() {
+				messages = append(messages, StreamMessage{ID: m.ID, Values: m.Values})
+			}
+			entry.Value = messages
+		default:
+			l.WarnLog("Skipping key '{{.redis_key}}' of type '{{.redis_type}}'.", map[string]interface{}{
+				"redis_key":  entry.Key,
+				"redis_type": entry.Type})
+			continue
+		}
+		result = append(result, entry)
+	}
+	l.DebugLog("Dumped {{.count}} keys from redis.", map[string]interface{}{
+		"count": len(result)})
+	return result, nil
+}
+
+// Restore writes all entries to redis in a single transaction, replacing existing keys.
+// The values are expected as returned by Dump or as decoded from its JSON representation.
+// The time to live of each entry is reduced by elapsed, the time passed since the entries have been dumped. Entries which expired in the meantime are skipped.
+// It returns the number of restored keys.
+func (r *Client) Restore(entries []Entry, elapsed time.Duration) (int, error) {
+	restored := 0
+	_, err := r.client.TxPipelined(func(p redis.Pipeliner) error {
+		for _, entry := range entries {
+			ttl := time.Duration(entry.TTL) * time.Millisecond
+			if entry.TTL >= 0 {
+				ttl -= elapsed
+				if ttl <= 0 {
+					continue
+				}
+			}
+			key := r.key(entry.Key)
+			p.Del(key)
+			switch value := entry.Value.(type) {
+			case string:
+				p.Set(key, value, 0)
+			case map[string]string:
+				fields := map[string]interface{}{}
+				for k, v := range value {
+					fields[k] = v
+				}
+				p.HMSet(key, fields)
+			case map[string]interface{}:
+				p.HMSet(key, value)
+			case []string:
+				for _, v := range value {
+					p.RPush(key, v)
+				}
+			case []interface{}:
+				if entry.Type == "stream" {
+					for _, m := range value {
+						message, _ := m.(map[string]interface{})
+						values, _ := message["values"].(map[string]interface{})
+						p.XAdd(&redis.XAddArgs{Stream: key, ID: fmt.Sprint(message["id"]), Values: values})
+					}
+				} else {
+					p.RPush(key, value...)
+				}
+			default:
+				l.WarnLog("Skipping key '{{.redis_key}}' of type '{{.redis_type}}'.", map[string]interface{}{
+					"redis_key":  entry.Key,
+					"redis_type": entry.Type})
+				continue
+			}
+			if entry.TTL >= 0 {
+				p.PExpire(key, ttl)
+			}
+			restored++
+		}
+		return nil
+	})
+	if err = r.track(err); err != nil {
+		l.ErrorLog(err, "There was an error while restoring {{.count}} keys in redis.", map[string]interface{}{
+			"count": len(entries)})
+		return 0, err
+	}
+	l.DebugLog("Restored {{.count}} keys in redis.", map[string]interface{}{
+		"count": restored})
+	return restored, nil
+}
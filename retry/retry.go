@@ -0,0 +1,143 @@
+package retry
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/metrics"
+	"niecke-it.de/veloci-meter/notify"
+)
+
+// Queue stores the results which could not be sent. Storing a result replaces the queued result of the same rule.
+type Queue interface {
+	Load() ([]notify.Result, error)
+	Store(results []notify.Result) error
+	Remove(names []string) error
+}
+
+// Notifier queues the results the wrapped notifier failed to send and sends them again with an exponential backoff.
+// Only the latest result of each rule is kept, results of the current run replace queued results of the same rule.
+type Notifier struct {
+	name       string
+	next       notify.Notifier
+	queue      Queue
+	maxSize    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu      sync.Mutex
+	wait    time.Duration
+	retryAt time.Time
+}
+
+// New wraps the notifier next, name identifies the notifier in logs and metrics.
+func New(name string, next notify.Notifier, queue Queue, c *config.Retry) *Notifier {
+	return &Notifier{
+		name:       name,
+		next:       next,
+		queue:      queue,
+		maxSize:    c.MaxSize,
+		backoff:    time.Duration(c.Backoff) * time.Second,
+		maxBackoff: time.Duration(c.MaxBackoff) * time.Second,
+	}
+}
+
+// Notify sends the queued results together with the results of the current run.
+// While backing off after a failure the results are only queued and nil is returned.
+func (n *Notifier) Notify(ctx context.Context, results []notify.Result) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// without the queue the current results are still sent
+	queued, _ := n.queue.Load()
+	pending := coalesce(queued, results)
+
+	now := time.Now()
+	if now.Before(n.retryAt) {
+		n.store(pending)
+		l.WarnLog("Notifier {{.notifier}} is backing up, {{.count}} results are queued. Next retry in {{.retry_in}}.", map[string]interface{}{
+			"notifier": n.name,
+			"count":    len(pending),
+			"retry_in": n.retryAt.Sub(now).Round(time.Second).String(),
+		})
+		return nil
+	}
+
+	if err := n.next.Notify(ctx, pending); err != nil {
+		n.wait *= 2
+		if n.wait == 0 {
+			n.wait = n.backoff
+		}
+		if n.wait > n.maxBackoff {
+			n.wait = n.maxBackoff
+		}
+		n.retryAt = now.Add(n.wait)
+		n.store(pending)
+		l.WarnLog("Notifier {{.notifier}} failed, {{.count}} results are queued. Next retry in {{.retry_in}}.", map[string]interface{}{
+			"notifier": n.name,
+			"count":    len(pending),
+			"retry_in": n.wait.String(),
+		})
+		return err
+	}
+
+	if len(queued) > 0 {
+		names := make([]string, 0, len(queued))
+		for _, res := range queued {
+			names = append(names, res.Name)
+		}
+		if err := n.queue.Remove(names); err == nil {
+			metrics.RetryQueueLength.WithLabelValues(n.name).Set(0)
+		}
+		l.InfoLog("Notifier {{.notifier}} recovered, {{.count}} queued results were sent.", map[string]interface{}{
+			"notifier": n.name,
+			"count":    len(queued),
+		})
+	}
+	n.wait = 0
+	return nil
+}
+
+// store queues the pending results. If there are more than maxSize results the oldest are dropped.
+func (n *Notifier) store(pending []notify.Result) {
+	if len(pending) > n.maxSize {
+		sort.SliceStable(pending, func(i, j int) bool {
+			return pending[i].End.Before(pending[j].End)
+		})
+		dropped := pending[:len(pending)-n.maxSize]
+		pending = pending[len(pending)-n.maxSize:]
+		names := make([]string, 0, len(dropped))
+		for _, res := range dropped {
+			names = append(names, res.Name)
+		}
+		n.queue.Remove(names)
+		metrics.RetryDropped.WithLabelValues(n.name).Add(float64(len(dropped)))
+		l.WarnLog("The retry queue of notifier {{.notifier}} is full, {{.count}} results were dropped.", map[string]interface{}{
+			"notifier": n.name,
+			"count":    len(dropped),
+			"max_size": n.maxSize,
+		})
+	}
+	if err := n.queue.Store(pending); err == nil {
+		metrics.RetryQueueLength.WithLabelValues(n.name).Set(float64(len(pending)))
+	}
+}
+
+// coalesce returns the queued results which are not replaced by a current result followed by the current results.
+func coalesce(queued []notify.Result, results []notify.Result) []notify.Result {
+	current := make(map[string]bool, len(results))
+	for _, res := range results {
+		current[res.Name] = true
+	}
+	pending := make([]notify.Result, 0, len(queued)+len(results))
+	for _, res := range queued {
+		if !current[res.Name] {
+			pending = append(pending, res)
+		}
+	}
+	return append(pending, results...)
+}
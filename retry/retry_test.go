@@ -0,0 +1,112 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+type recorder struct {
+	results []notify.Result
+	err     error
+}
+
+func (r *recorder) Notify(ctx context.Context, results []notify.Result) error {
+	r.results = append(r.results, results...)
+	return r.err
+}
+
+type memQueue map[string]notify.Result
+
+func (q memQueue) Load() ([]notify.Result, error) {
+	results := []notify.Result{}
+	for _, res := range q {
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func (q memQueue) Store(results []notify.Result) error {
+	for _, res := range results {
+		q[res.Name] = res
+	}
+	return nil
+}
+
+func (q memQueue) Remove(names []string) error {
+	for _, name := range names {
+		delete(q, name)
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	r := &recorder{err: errors.New("failed")}
+	q := memQueue{}
+	n := New("test", r, q, &config.Retry{MaxSize: 10, Backoff: 60, MaxBackoff: 600})
+
+	err := n.Notify(context.Background(), []notify.Result{{Name: "first", State: notify.CRITICAL}, {Name: "second"}})
+	test.CheckResult(t, err, r.err)
+	test.CheckResult(t, len(q), 2)
+	test.CheckResult(t, n.wait, time.Minute)
+
+	// results are only queued while backing off, the latest state of a rule is kept
+	r.results = nil
+	err = n.Notify(context.Background(), []notify.Result{{Name: "first", State: notify.OK}})
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, len(r.results), 0)
+	test.CheckResult(t, len(q), 2)
+	test.CheckResult(t, q["first"].State, notify.OK)
+
+	// the backoff doubles with each failure
+	n.retryAt = time.Time{}
+	err = n.Notify(context.Background(), []notify.Result{{Name: "third"}})
+	test.CheckResult(t, err, r.err)
+	test.CheckResult(t, len(r.results), 3)
+	test.CheckResult(t, n.wait, 2*time.Minute)
+
+	// queued results are sent with the current results once the notifier recovered
+	r.results = nil
+	r.err = nil
+	n.retryAt = time.Time{}
+	err = n.Notify(context.Background(), []notify.Result{{Name: "second", State: notify.WARNING}})
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, len(r.results), 3)
+	test.CheckResult(t, r.results[2].Name, "second")
+	test.CheckResult(t, r.results[2].State, notify.WARNING)
+	test.CheckResult(t, len(q), 0)
+	test.CheckResult(t, n.wait, time.Duration(0))
+}
+
+func TestRetryMaxBackoff(t *testing.T) {
+	r := &recorder{err: errors.New("failed")}
+	n := New("test", r, memQueue{}, &config.Retry{MaxSize: 10, Backoff: 60, MaxBackoff: 90})
+
+	for i := 0; i < 3; i++ {
+		n.retryAt = time.Time{}
+		n.Notify(context.Background(), []notify.Result{{Name: "rule"}})
+	}
+	test.CheckResult(t, n.wait, 90*time.Second)
+}
+
+func TestRetryMaxSize(t *testing.T) {
+	r := &recorder{err: errors.New("failed")}
+	q := memQueue{}
+	n := New("test", r, q, &config.Retry{MaxSize: 2, Backoff: 60, MaxBackoff: 600})
+
+	now := time.Now()
+	n.Notify(context.Background(), []notify.Result{
+		{Name: "first", End: now.Add(-2 * time.Minute)},
+		{Name: "second", End: now},
+		{Name: "third", End: now.Add(-time.Minute)},
+	})
+	// the oldest result is dropped
+	test.CheckResult(t, len(q), 2)
+	_, ok := q["first"]
+	test.CheckResult(t, ok, false)
+}
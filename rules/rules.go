@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	l "niecke-it.de/veloci-meter/logging"
 )
@@ -34,11 +35,56 @@ type Rule struct {
 }
 
 // GlobalPatterns matches the redis prefixes to the different global rules.
+// The prefixes are relative to Redis.KeyPrefix which is added by the rdb package.
 var GlobalPatterns = map[string]string{
 	"5m":  "global:5:",
 	"60m": "global:60:",
 }
 
+// GlobalNames matches the names of the checks reported for the different global rules.
+var GlobalNames = map[string]string{
+	"5m":  "Global 5m",
+	"60m": "Global 60m",
+}
+
+// Unknown is used instead of a rule name for mails not matching any rule, e.g. in the events of the redis stream.
+// Rules can not use this name.
+const Unknown = "unknown"
+
+// Check is a check reported to the monitoring. There is one check for each rule and each global rule.
+type Check struct {
+	Name    string
+	Pattern string
+}
+
+// Checks returns the checks of all rules followed by the checks of the global rules.
+func (r *Rules) Checks() []Check {
+	checks := make([]Check, 0, len(r.Rules)+2)
+	for _, rule := range r.Rules {
+		checks = append(checks, Check{Name: rule.Name, Pattern: rule.Pattern})
+	}
+	for _, g := range []string{"5m", "60m"} {
+		checks = append(checks, Check{Name: GlobalNames[g], Pattern: GlobalNames[g]})
+	}
+	return checks
+}
+
+// ID returns the identity of a rule which is used to store and count the mails matched by this rule.
+// Since the name of a rule must be unique the name is used, so editing the pattern does not reset the count.
+func (r *Rule) ID() string {
+	return r.Name
+}
+
+// Match returns the first rule whose pattern is contained in the subject or nil if no rule matches.
+func (r *Rules) Match(subject string) *Rule {
+	for i := range r.Rules {
+		if strings.Contains(subject, r.Rules[i].Pattern) {
+			return &r.Rules[i]
+		}
+	}
+	return nil
+}
+
 // ToString formats a rule as string for printing it to console.
 func (r *Rule) ToString() string {
 	return fmt.Sprintf("Name: '%v' | Pattern: '%v' | Timeframe: '%v' | Ok: '%v' | Warning: '%v' | Critical: '%v'", r.Name, r.Pattern, r.Timeframe, r.Ok, r.Warning, r.Critical)
@@ -67,8 +113,16 @@ func LoadRules(path string) (r *Rules) {
 		})
 	}
 
+	names := map[string]bool{}
 	for i, r := range rules.Rules {
 		checkRule(i, r)
+		if names[r.ID()] {
+			l.FatalLog(nil, "Rule name '{{.rule_name}}' is used more than once.", map[string]interface{}{
+				"rule_name": r.Name,
+				"rule_id":   i,
+			})
+		}
+		names[r.ID()] = true
 	}
 	l.InfoLog("Successfully loaded the rules from {{.path}}", map[string]interface{}{"fullpath": path})
 	return &rules
@@ -85,6 +139,13 @@ func checkRule(id int, r Rule) {
 		})
 	}
 
+	if r.Name == Unknown {
+		l.FatalLog(nil, "The rule name '{{.rule_name}}' is reserved for mails not matching any rule.", map[string]interface{}{
+			"rule_name": r.Name,
+			"rule_id":   id,
+		})
+	}
+
 	// check any limit is defined
 	if r.Warning == 0 && r.Critical == 0 && r.Ok == 0 {
 		l.FatalLog(nil, "No warning, critical or ok limit defined.", map[string]interface{}{
@@ -102,6 +102,38 @@ func TestLoadRulesMissingTimeframe(t *testing.T) {
 	test.CheckResult(t, fatal, true)
 }
 
+func TestLoadRulesDuplicateName(t *testing.T) {
+	defer func() { l.StandardLogger().ExitFunc = nil }()
+	var fatal bool
+	l.StandardLogger().ExitFunc = func(int) { fatal = true }
+
+	fatal = false
+	LoadRules("rules.duplicate.json")
+	test.CheckResult(t, fatal, true)
+}
+
+func TestMatch(t *testing.T) {
+	r := LoadRules("rules.example.json")
+	test.CheckResult(t, r.Match("a warning mail").Name, "warning")
+	test.CheckResult(t, r.Match("critical and warning").Name, "warning")
+	test.CheckResult(t, r.Match("unknown") == nil, true)
+}
+
+func TestID(t *testing.T) {
+	r := LoadRules("rules.example.json").Rules[0]
+	test.CheckResult(t, r.ID(), "full")
+}
+
+func TestChecks(t *testing.T) {
+	r := LoadRules("rules.example.json")
+	checks := r.Checks()
+	test.CheckResult(t, len(checks), len(r.Rules)+2)
+	test.CheckResult(t, checks[0].Name, "full")
+	test.CheckResult(t, checks[0].Pattern, "full")
+	test.CheckResult(t, checks[len(checks)-2].Name, "Global 5m")
+	test.CheckResult(t, checks[len(checks)-1].Name, "Global 60m")
+}
+
 func TestLoadRulesIOError(t *testing.T) {
 	defer func() { l.StandardLogger().ExitFunc = nil }()
 	var fatal bool
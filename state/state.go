@@ -0,0 +1,84 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/rdb"
+)
+
+// Version is the format version of the snapshots written by Export. Import only accepts snapshots of this version.
+const Version = 1
+
+// Snapshot is the portable representation of the state of veloci-meter in redis.
+// It contains the mail windows with their remaining time to live, the global counters, the statistics and the recent matches.
+type Snapshot struct {
+	Version    int         `json:"version"`
+	ExportedAt time.Time   `json:"exported_at"`
+	Keys       []rdb.Entry `json:"keys"`
+}
+
+// Export writes all keys of veloci-meter from the redis server defined by the config to a JSON file at path.
+func Export(conf *config.Config, path string) error {
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	entries, err := r.Dump()
+	if err != nil {
+		return err
+	}
+	snapshot := Snapshot{Version: Version, ExportedAt: time.Now(), Keys: entries}
+
+	b, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		l.ErrorLog(err, "Error while marshaling state to JSON", nil)
+		return err
+	}
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		l.ErrorLog(err, "Error while writing state to file at {{.fullpath}}", map[string]interface{}{
+			"fullpath": path})
+		return err
+	}
+	l.InfoLog("Exported {{.count}} keys to {{.fullpath}}.", map[string]interface{}{
+		"count":    len(entries),
+		"fullpath": path})
+	return nil
+}
+
+// Import restores all keys from a JSON file at path written by Export to the redis server defined by the config.
+// The time to live of the mail windows is reduced by the time passed since the export, so the windows stay accurate.
+func Import(conf *config.Config, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		l.ErrorLog(err, "Error while reading state from file at {{.fullpath}}", map[string]interface{}{
+			"fullpath": path})
+		return err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		l.ErrorLog(err, "Can't parse state file '{{.fullpath}}'", map[string]interface{}{
+			"fullpath": path})
+		return err
+	}
+	if snapshot.Version != Version {
+		err := fmt.Errorf("unsupported state version %d, expected %d", snapshot.Version, Version)
+		l.ErrorLog(err, "Can't import state file '{{.fullpath}}'", map[string]interface{}{
+			"fullpath": path})
+		return err
+	}
+
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	elapsed := time.Since(snapshot.ExportedAt)
+	count, err := r.Restore(snapshot.Keys, elapsed)
+	if err != nil {
+		return err
+	}
+	l.InfoLog("Imported {{.count}} of {{.total}} keys from {{.fullpath}}.", map[string]interface{}{
+		"count":    count,
+		"total":    len(snapshot.Keys),
+		"fullpath": path,
+		"elapsed":  elapsed})
+	return nil
+}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/rdb"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestExportImport(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	conf.Redis.Stream = "events"
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	r.Client().FlushDB()
+
+	msg := imap.Message{Envelope: &imap.Envelope{Subject: "Test", MessageId: "<1@local>"}}
+	b := r.NewBatch()
+	b.Claim(&msg)
+	b.StoreMail("Test rule", &msg, 60, time.Now())
+	b.StoreMail("Test rule", &msg, 60, time.Now())
+	b.StoreMatch("Test rule", rdb.NewMatch(&msg, "INBOX"), 900)
+	b.IncreaseStatisticCountMail("Test rule")
+	b.IncreaseGlobalCounter(5, time.Now())
+	b.PublishEvent("Test rule", &msg, time.Now())
+	test.CheckResult(t, b.Exec(), nil)
+	r.Client().Set("other:key", 1, 0)
+
+	f, _ := ioutil.TempFile("", "state")
+	defer os.Remove(f.Name())
+	test.CheckResult(t, Export(conf, f.Name()), nil)
+
+	r.Client().FlushDB()
+	test.CheckResult(t, Import(conf, f.Name()), nil)
+
+	count, _ := r.CountMail("Test rule")
+	test.CheckResult(t, count, int64(2))
+	c, _ := r.GetGlobalCounter(5)
+	test.CheckResult(t, c, 1)
+	test.CheckResult(t, r.GetStatisticCount("Test rule", int(time.Now().Unix())).Mail, int64(1))
+	matches, _ := r.GetMatches("Test rule", 10)
+	test.CheckResult(t, len(matches), 1)
+	test.CheckResult(t, matches[0].MessageID, "<1@local>")
+	test.CheckResult(t, r.Client().XLen("events").Val(), int64(1))
+
+	// the mail windows keep their remaining ttl
+	keys, _ := r.GetKeys("mail:*")
+	ttl := r.Client().PTTL(keys[0]).Val()
+	test.CheckResult(t, ttl > 50*time.Second && ttl <= 60*time.Second, true)
+
+	// the mail is still known as counted
+	b = r.NewBatch()
+	b.Prepare([]*imap.Message{&msg})
+	test.CheckResult(t, b.Claim(&msg), false)
+
+	// keys not written by veloci-meter are not exported
+	test.CheckResult(t, r.Client().Exists("other:key").Val(), int64(0))
+
+	r.Client().FlushDB()
+}
+
+func TestImportExpired(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	r.Client().FlushDB()
+
+	entries := []rdb.Entry{
+		{Key: "mail:expired:1", Type: "string", TTL: 1000, Value: "1"},
+		{Key: "mail:valid:1", Type: "string", TTL: 60000, Value: "1"},
+		{Key: "stats:rule:1606003200", Type: "hash", TTL: -1, Value: map[string]string{"mail": "3"}},
+	}
+	count, err := r.Restore(entries, 10*time.Second)
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, count, 2)
+	test.CheckResult(t, r.Client().Exists("mail:expired:1").Val(), int64(0))
+	test.CheckResult(t, r.Client().HGet("stats:rule:1606003200", "mail").Val(), "3")
+	test.CheckResult(t, r.Client().TTL("stats:rule:1606003200").Val() < 0, true)
+
+	r.Client().FlushDB()
+}
+
+func TestImportVersion(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	r := rdb.NewClient(&conf.Redis, conf.Location)
+	r.Client().FlushDB()
+
+	f, _ := ioutil.TempFile("", "state")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"version": 2, "keys": [{"key": "mail:rule:1", "type": "string", "ttl": -1, "value": "1"}]}`)
+	f.Close()
+
+	test.CheckResult(t, Import(conf, f.Name()) != nil, true)
+	test.CheckResult(t, r.Client().Exists("mail:rule:1").Val(), int64(0))
+
+	r.Client().FlushDB()
+}
+
+func TestImportMissingFile(t *testing.T) {
+	conf := config.LoadConfig("../config/config.example.json")
+	test.CheckResult(t, Import(conf, "state.missing.json") != nil, true)
+}
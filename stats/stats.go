@@ -2,7 +2,6 @@ package stats
 
 import (
 	"encoding/json"
-	"math"
 	"os"
 	"time"
 
@@ -12,13 +11,13 @@ import (
 	"niecke-it.de/veloci-meter/rules"
 )
 
-func ExportJob(conf *config.Config, rules rules.Rules) {
-	// get a timestamp from yesterday
-	timestamp := int(time.Now().Unix()) - 24*60*60
-	timestampDay := int64(timestamp - int(math.Mod(float64(timestamp), float64(24*60*60))))
-	m := map[string]interface{}{"time": time.Unix(timestampDay, 0).Format(time.RFC3339), "stats": nil}
+func ExportJob(conf *config.Config, rules rules.Rules, r *rdb.Client) {
+	// get the start of yesterday in the configured timezone
+	now := time.Now().In(conf.Location)
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, conf.Location)
+	timestamp := int(yesterday.Unix())
+	m := map[string]interface{}{"time": yesterday.Format(time.RFC3339), "stats": nil}
 	statsList := []rdb.Stats{}
-	r := rdb.NewClient(&conf.Redis)
 
 	for _, rule := range rules.Rules {
 		stats := r.GetStatisticCount(rule.Name, timestamp)
@@ -40,7 +39,7 @@ func ExportJob(conf *config.Config, rules rules.Rules) {
 		writeToFile("stats", string(b))
 	}
 	l.InfoLog("Stats reported to file.", map[string]interface{}{
-		"stats_day": time.Unix(timestampDay, 0).Format(time.RFC3339)})
+		"stats_day": yesterday.Format(time.RFC3339)})
 }
 
 func writeToFile(path string, content string) {
@@ -17,7 +17,7 @@ import (
 func TestExportJobMail(t *testing.T) {
 	config := config.LoadConfig("../config/config.example.json")
 	rs := rules.LoadRules("../rules.example.json")
-	r := rdb.NewClient(&config.Redis)
+	r := rdb.NewClient(&config.Redis, config.Location)
 	r.Client().FlushDB()
 
 	ts := int(time.Now().Unix()) - (24 * 60 * 60)
@@ -30,7 +30,7 @@ func TestExportJobMail(t *testing.T) {
 			t.Errorf("TestExportJob() test returned an unexpected result: [%v]", err)
 		}
 	}
-	ExportJob(config, *rs)
+	ExportJob(config, *rs, r)
 
 	content, err := ioutil.ReadFile("stats")
 	if err != nil {
@@ -38,7 +38,7 @@ func TestExportJobMail(t *testing.T) {
 	}
 
 	result := string(content)
-	expected := fmt.Sprintf("{\"stats\":[{\"Name\":\"first rule\",\"Mail\":1,\"Warning\":0,\"Critical\":0},{\"Name\":\"another rule\",\"Mail\":1,\"Warning\":0,\"Critical\":0},{\"Name\":\"positive rule\",\"Mail\":1,\"Warning\":0,\"Critical\":0}],\"time\":\"%v\"}\n", time.Unix(int64(timestampDay), 0).Format(time.RFC3339))
+	expected := fmt.Sprintf("{\"stats\":[{\"Name\":\"first rule\",\"Mail\":1,\"Warning\":0,\"Critical\":0},{\"Name\":\"another rule\",\"Mail\":1,\"Warning\":0,\"Critical\":0},{\"Name\":\"positive rule\",\"Mail\":1,\"Warning\":0,\"Critical\":0}],\"time\":\"%v\"}\n", time.Unix(int64(timestampDay), 0).In(config.Location).Format(time.RFC3339))
 	test.CheckResult(t, result, expected)
 
 	os.Remove("stats")
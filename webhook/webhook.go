@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/notify"
+)
+
+// DefaultTemplate is used if no template is configured for a webhook.
+const DefaultTemplate = `{"name":{{json .Name}},"pattern":{{json .Pattern}},"state":"{{.State}}","count":{{.Count}},"output":{{json .Output}}}`
+
+// Notifier sends each check result to a webhook. The request body is rendered with a text/template.
+type Notifier struct {
+	c        *config.Webhook
+	client   *http.Client
+	template *template.Template
+}
+
+var funcs = template.FuncMap{
+	// json encodes a value as json, e.g. to quote and escape strings.
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// New returns a notifier for the webhook defined in the config. An error is returned if the template can not be parsed.
+func New(c *config.Webhook) (*Notifier, error) {
+	text := c.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	t, err := template.New("webhook").Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{
+		c:        c,
+		client:   &http.Client{Timeout: time.Duration(c.Timeout) * time.Second},
+		template: t,
+	}, nil
+}
+
+// Notify sends one request per result. Every result is send, even if sending a previous one failed.
+// Once the context is done the remaining results are not send. The first error is returned.
+func (n *Notifier) Notify(ctx context.Context, results []notify.Result) error {
+	var first error
+	for i := range results {
+		if err := ctx.Err(); err != nil {
+			l.ErrorLog(err, "Sending the results to the webhook was aborted, {{.count}} results were not send.", map[string]interface{}{
+				"count": len(results) - i,
+			})
+			if first == nil {
+				first = err
+			}
+			break
+		}
+		if err := n.send(ctx, &results[i]); err != nil {
+			l.ErrorLog(err, "There was an error sending the result for {{.name}} to the webhook.", map[string]interface{}{
+				"name": results[i].Name,
+			})
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// send renders the body for the result and sends it. Failed requests are retried with an exponential backoff,
+// unless the webhook rejected the request with a client error.
+func (n *Notifier) send(ctx context.Context, res *notify.Result) error {
+	var body bytes.Buffer
+	if err := n.template.Execute(&body, res); err != nil {
+		return err
+	}
+	retries := 0
+	if n.c.Retries != nil {
+		retries = *n.c.Retries
+	}
+	backoff := time.Duration(n.c.RetryBackoff) * time.Second
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = n.post(ctx, body.Bytes())
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+		l.WarnLog("Request to webhook failed. Retrying in {{.backoff}}.", map[string]interface{}{
+			"name":    res.Name,
+			"attempt": attempt + 1,
+			"backoff": backoff.String(),
+			"error":   err,
+		})
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// post sends a single request. It returns if a failed request should be retried.
+func (n *Notifier) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, n.c.Method, n.c.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.c.Headers {
+		req.Header.Set(k, v)
+	}
+	if n.c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.c.Token)
+	} else if n.c.User != "" {
+		req.SetBasicAuth(n.c.User, n.c.Password)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	// the body is read to reuse the connection
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook returned status %v", resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestNotify(t *testing.T) {
+	var body map[string]interface{}
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header = req.Header
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	n, err := New(&config.Webhook{URL: server.URL, Method: "POST", Token: "secret", Headers: map[string]string{"X-Source": "veloci-meter"}})
+	test.CheckResult(t, err, nil)
+	err = n.Notify(context.Background(), []notify.Result{{Name: "rule", Pattern: "\"Backup\"", State: notify.CRITICAL, Count: 4}})
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, header.Get("Authorization"), "Bearer secret")
+	test.CheckResult(t, header.Get("X-Source"), "veloci-meter")
+	test.CheckResult(t, body["name"], "rule")
+	test.CheckResult(t, body["pattern"], "\"Backup\"")
+	test.CheckResult(t, body["state"], "CRITICAL")
+	test.CheckResult(t, body["count"], float64(4))
+	test.CheckResult(t, body["output"], "[CRITICAL] Pattern: '\"Backup\"'")
+}
+
+func TestNotifyTemplate(t *testing.T) {
+	var body string
+	var user, password string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, _ = req.BasicAuth()
+		b, _ := ioutil.ReadAll(req.Body)
+		body = string(b)
+	}))
+	defer server.Close()
+
+	n, _ := New(&config.Webhook{URL: server.URL, Method: "PUT", User: "user", Password: "pass", Template: "{{.Name}} is {{.State}} ({{.Count}}/{{.Critical}})"})
+	err := n.Notify(context.Background(), []notify.Result{{Name: "rule", State: notify.WARNING, Count: 4, Critical: 5}})
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, body, "rule is WARNING (4/5)")
+	test.CheckResult(t, user, "user")
+	test.CheckResult(t, password, "pass")
+
+	_, err = New(&config.Webhook{URL: server.URL, Template: "{{.Name"})
+	test.CheckResult(t, err != nil, true)
+}
+
+func TestNotifyRetry(t *testing.T) {
+	requests := 0
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(status)
+		}
+	}))
+	defer server.Close()
+
+	retries := 3
+	n, _ := New(&config.Webhook{URL: server.URL, Method: "POST", Retries: &retries})
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "rule"}}), nil)
+	test.CheckResult(t, requests, 2)
+
+	// client errors are not retried
+	requests = 0
+	status = http.StatusBadRequest
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "rule"}}) != nil, true)
+	test.CheckResult(t, requests, 1)
+
+	// retries are disabled with 0
+	requests = 0
+	status = http.StatusServiceUnavailable
+	retries = 0
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "rule"}}) != nil, true)
+	test.CheckResult(t, requests, 1)
+}
+
+func TestNotifyCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		cancel()
+	}))
+	defer server.Close()
+
+	// the remaining results are not send once the context is canceled
+	n, _ := New(&config.Webhook{URL: server.URL, Method: "POST"})
+	err := n.Notify(ctx, []notify.Result{{Name: "first"}, {Name: "second"}, {Name: "third"}})
+	test.CheckResult(t, errors.Is(err, context.Canceled), true)
+	test.CheckResult(t, requests, 1)
+}
@@ -0,0 +1,160 @@
+package zabbix
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	l "niecke-it.de/veloci-meter/logging"
+	"niecke-it.de/veloci-meter/notify"
+)
+
+// header starts every message of the zabbix sender protocol. It is followed by the length of the data as 8 byte little endian.
+var header = []byte("ZBXD\x01")
+
+// maxResponse limits the size of a response read from the zabbix server.
+const maxResponse = 1 << 20
+
+// Item is a single value of a trapper item.
+type Item struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+}
+
+type request struct {
+	Request string `json:"request"`
+	Data    []Item `json:"data"`
+	Clock   int64  `json:"clock"`
+}
+
+type response struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+// Notifier sends the count and state of each rule as trapper items to a zabbix server or proxy.
+type Notifier struct {
+	c *config.Zabbix
+}
+
+// New returns a notifier for the zabbix server defined in the config.
+func New(c *config.Zabbix) *Notifier {
+	return &Notifier{c: c}
+}
+
+// ItemKey returns the key of the trapper item for the given name and rule, e.g. veloci-meter.count["rule"].
+func ItemKey(prefix, name, rule string) string {
+	return fmt.Sprintf("%s.%s[\"%s\"]", prefix, name, strings.Replace(rule, "\"", "\\\"", -1))
+}
+
+// Items returns the count and state items for all results.
+func (n *Notifier) Items(results []notify.Result, now time.Time) []Item {
+	items := make([]Item, 0, 2*len(results))
+	for _, res := range results {
+		items = append(items,
+			Item{Host: n.c.Hostname, Key: ItemKey(n.c.KeyPrefix, "count", res.Name), Value: fmt.Sprint(res.Count), Clock: now.Unix()},
+			Item{Host: n.c.Hostname, Key: ItemKey(n.c.KeyPrefix, "state", res.Name), Value: fmt.Sprint(int(res.State)), Clock: now.Unix()},
+		)
+	}
+	return items
+}
+
+// Notify sends all results with a single request.
+// Values of items which are not configured in zabbix are dropped by the server, so a warning is logged if the server reports failed items.
+func (n *Notifier) Notify(ctx context.Context, results []notify.Result) error {
+	now := time.Now()
+	resp, err := n.send(ctx, &request{Request: "sender data", Data: n.Items(results, now), Clock: now.Unix()})
+	if err != nil {
+		l.ErrorLog(err, "There was an error sending data to zabbix.", map[string]interface{}{
+			"server": n.c.Server,
+		})
+		return err
+	}
+	if resp.Response != "success" {
+		err = fmt.Errorf("zabbix returned %v: %v", resp.Response, resp.Info)
+		l.ErrorLog(err, "Zabbix did not accept the data.", map[string]interface{}{
+			"server": n.c.Server,
+		})
+		return err
+	}
+	if !strings.Contains(resp.Info, "failed: 0;") {
+		l.WarnLog("Zabbix did not process all items. Check that the trapper items exist: {{.info}}", map[string]interface{}{
+			"info": resp.Info,
+		})
+	} else {
+		l.DebugLog("Result from zabbix: {{.info}}", map[string]interface{}{
+			"info": resp.Info,
+		})
+	}
+	return nil
+}
+
+func (n *Notifier) send(ctx context.Context, req *request) (*response, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(n.c.Timeout)*time.Second)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.c.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(Encode(data)); err != nil {
+		return nil, err
+	}
+	body, err := Decode(conn)
+	if err != nil {
+		return nil, err
+	}
+	var resp response
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Encode adds the protocol header to the data.
+func Encode(data []byte) []byte {
+	var b bytes.Buffer
+	b.Write(header)
+	binary.Write(&b, binary.LittleEndian, uint64(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+// Decode reads a message and returns its data without the protocol header.
+func Decode(r io.Reader) ([]byte, error) {
+	h := make([]byte, len(header)+8)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:len(header)], header) {
+		return nil, errors.New("invalid zabbix protocol header")
+	}
+	size := binary.LittleEndian.Uint64(h[len(header):])
+	if size > maxResponse {
+		return nil, fmt.Errorf("zabbix message of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,86 @@
+package zabbix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"niecke-it.de/veloci-meter/config"
+	"niecke-it.de/veloci-meter/notify"
+	"niecke-it.de/veloci-meter/test"
+)
+
+func TestItemKey(t *testing.T) {
+	test.CheckResult(t, ItemKey("veloci-meter", "count", "first rule"), "veloci-meter.count[\"first rule\"]")
+	test.CheckResult(t, ItemKey("veloci-meter", "state", "say \"hi\""), "veloci-meter.state[\"say \\\"hi\\\"\"]")
+}
+
+func TestEncodeDecode(t *testing.T) {
+	b := Encode([]byte("{}"))
+	test.CheckResult(t, string(b[:5]), "ZBXD\x01")
+	test.CheckResult(t, b[5], byte(2))
+	test.CheckResult(t, len(b), 15)
+
+	data, err := Decode(bytes.NewReader(b))
+	test.CheckResult(t, err, nil)
+	test.CheckResult(t, string(data), "{}")
+
+	_, err = Decode(bytes.NewReader([]byte("HTTP/1.1 400 Bad Request")))
+	test.CheckResult(t, err != nil, true)
+}
+
+func TestNotify(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer ln.Close()
+	received := make(chan request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := Decode(conn)
+		var req request
+		json.Unmarshal(data, &req)
+		received <- req
+		conn.Write(Encode([]byte(`{"response":"success","info":"processed: 4; failed: 0; total: 4; seconds spent: 0.000055"}`)))
+	}()
+
+	n := New(&config.Zabbix{Server: ln.Addr().String(), Hostname: "MAIL", KeyPrefix: "veloci-meter", Timeout: 1})
+	results := []notify.Result{{Name: "first", State: notify.WARNING, Count: 3}, {Name: "Global 5m", Count: 1}}
+	test.CheckResult(t, n.Notify(context.Background(), results), nil)
+
+	req := <-received
+	test.CheckResult(t, req.Request, "sender data")
+	test.CheckResult(t, len(req.Data), 4)
+	test.CheckResult(t, req.Data[0].Host, "MAIL")
+	test.CheckResult(t, req.Data[0].Key, "veloci-meter.count[\"first\"]")
+	test.CheckResult(t, req.Data[0].Value, "3")
+	test.CheckResult(t, req.Data[1].Key, "veloci-meter.state[\"first\"]")
+	test.CheckResult(t, req.Data[1].Value, "1")
+	test.CheckResult(t, req.Data[2].Key, "veloci-meter.count[\"Global 5m\"]")
+	test.CheckResult(t, req.Data[0].Clock > time.Now().Unix()-10, true)
+}
+
+func TestNotifyError(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		Decode(conn)
+		conn.Write(Encode([]byte(`{"response":"failed","info":"invalid data"}`)))
+	}()
+
+	n := New(&config.Zabbix{Server: ln.Addr().String(), Hostname: "MAIL", KeyPrefix: "veloci-meter", Timeout: 1})
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "first"}}) != nil, true)
+
+	// the server is not reachable anymore
+	ln.Close()
+	test.CheckResult(t, n.Notify(context.Background(), []notify.Result{{Name: "first"}}) != nil, true)
+}